@@ -0,0 +1,99 @@
+package btree
+
+import (
+	"errors"
+	"github.com/MattParker89/seaquell/storage"
+	"sort"
+)
+
+/*
+InsertBatch puts many keys in the tree at once. The batch is sorted and
+cut into runs of keys that go in the same leaf. A run latches its way down
+once for its first key, the rest of it is put in the leaf in memory and
+the last key is inserted the usual way, so the leaf is written once and
+splits like it would for a single insert.
+
+A run ends at the first key that might belong in another leaf, that is one
+that isn't smaller than the leaf's last key, unless the run is past the end
+of the tree. It also ends when the leaf is full, the split makes room for
+the next run.
+*/
+
+var ErrBatchLength = errors.New("btree: a batch needs a value for every key")
+
+//InsertBatch adds the values under their keys, replacing the old values of keys that are
+//already there. If a key is in the batch more than once the last value wins.
+//Nothing is inserted if any of the cells is too large.
+func (t *BTree) InsertBatch(keys [][]byte, values [][]byte) error {
+	if len(keys) != len(values) {
+		return ErrBatchLength
+	}
+	for x, k := range keys {
+		if storage.LeafCellSize(k, values[x]) > pageCapacity/4 {
+			return ErrValueTooLarge
+		}
+	}
+	order := make([]int, len(keys))
+	for x := range order {
+		order[x] = x
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return t.compare(keys[order[a]], keys[order[b]]) < 0
+	})
+
+	//of equal keys only the last one in the batch is kept
+	sorted := make([][]byte, 0, len(keys))
+	sortedValues := make([][]byte, 0, len(keys))
+	for x, o := range order {
+		if x+1 < len(order) && t.compare(keys[o], keys[order[x+1]]) == 0 {
+			continue
+		}
+		sorted = append(sorted, keys[o])
+		sortedValues = append(sortedValues, values[o])
+	}
+
+	for len(sorted) > 0 {
+		n := t.insertRun(sorted, sortedValues)
+		sorted, sortedValues = sorted[n:], sortedValues[n:]
+	}
+	return nil
+}
+
+//insertRun inserts the sorted keys that go in the leaf of the first one
+//and returns how many that was
+func (t *BTree) insertRun(keys [][]byte, values [][]byte) int {
+	w := t.latchPath(keys[0], batchSafe(keys[0], values[0]))
+	defer w.release()
+	l := w.leaf()
+	n := 0
+	for ; n+1 < len(keys); n++ {
+		l.put(keys[n], values[n])
+		if !leafFits(l.keys, l.values) || !w.holds(keys[n+1]) {
+			break
+		}
+	}
+	//putting the key again only replaces its value with the same one
+	t.insert(w, keys[n], values[n])
+	return n + 1
+}
+
+//batchSafe is insertSafe for a run of keys. More than one key goes in the leaf
+//so it's never safe, the split is decided by the last one.
+func batchSafe(key []byte, value []byte) func(noder, bool) bool {
+	safe := insertSafe(key, value)
+	return func(n noder, isRoot bool) bool {
+		if _, ok := n.(*leafNode); ok {
+			return false
+		}
+		return safe(n, isRoot)
+	}
+}
+
+//holds says if key surely belongs in the path's leaf
+func (w *writePath) holds(key []byte) bool {
+	if w.appending {
+		return true
+	}
+	l := w.leaf()
+	return len(l.keys) > 0 && w.tree.compare(key, l.keys[len(l.keys)-1]) < 0
+}
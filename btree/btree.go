@@ -1,128 +1,501 @@
 package btree
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"github.com/MattParker89/seaquell/storage"
+	"sync"
 )
 
 /*
 A key's right child is inclusive of the key
 The left child is < the key
+
+Keys are byte strings ordered by the tree's Comparator.
+The int methods store their keys big-endian so byte order is number order.
+
+Nodes split when their cells no longer fit in a page and get rebalanced
+when they are less than a quarter full.
+
+A tree can be read and written from several goroutines at once, see latch.go.
+A Cursor belongs to the goroutine using it.
 */
 
+//pageCapacity is the number of bytes a node may fill. Tests shrink it to grow deep trees.
+var pageCapacity = storage.PAGE_CAPACITY
+
+//max_fill_factor leaves the right node of a split at least a quarter of a page
+const max_fill_factor = 0.75
+
+//A cell can take up at most a quarter of a page so splitting in two always works
+var ErrValueTooLarge = errors.New("btree: value is too large for a page")
+var ErrKeyExists = errors.New("btree: key already exists")
+var ErrKeyNotFound = errors.New("btree: key not found")
+
+//Conflict says what an insert does when the key is already in the tree
+type Conflict int
+
 const (
-	NODE_ORDER = 4
+	CONFLICT_REPLACE Conflict = iota //overwrite the old value
+	CONFLICT_FAIL                    //leave the old value and return ErrKeyExists
+	CONFLICT_IGNORE                  //leave the old value and return nil
 )
 
-type cursor struct {
-	node  *leafNode
-	index int
-}
+//Comparator orders keys. It returns a negative number when a < b,
+//0 when they are equal and a positive number when a > b.
+type Comparator func(a, b []byte) int
 
 type BTree struct {
-	root   noder
-	cursor cursor
+	rootLatch  sync.RWMutex //guards root, write latched while the root might change
+	root       noder
+	comparator Comparator   //nil means bytes.Compare
+	cursor     *Cursor      //used by the Cursor* methods
+	version    uint64       //bumped on every change so cursors know to seek again, use atomically
+	fillFactor float64      //how full splits leave the left node, 0 means half
+	cow        *copyOnWrite //nil unless the tree is copy-on-write, see cow.go
+	cache      *nodeCache   //the nodes kept in memory, see cache.go
+	counted    bool         //interior nodes keep how many rows are under each child, see count.go
+}
+
+func newTree() *BTree {
+	t := &BTree{cache: newNodeCache()}
+	t.cursor = t.NewCursor()
+	return t
 }
 
 func New() *BTree {
-	return &BTree{
-		root: &leafNode{
-			page: storage.NewPage(),
-		},
+	t := newTree()
+	t.root = &leafNode{
+		page: storage.NewPage(),
+		tree: t,
+	}
+	return t
+}
+
+//NewIn creates a tree whose pages live in s instead of the main database file.
+//Use it with storage.CreateTemp for scratch trees.
+func NewIn(s storage.Storer) *BTree {
+	t := newTree()
+	t.root = &leafNode{
+		page: storage.NewPageIn(s),
+		tree: t,
 	}
+	return t
 }
 
 func Fetch(number int) *BTree {
-	rootPage := storage.GetPageNumber(number)
-	switch rootPage.Type() {
-	case storage.LEAF_NODE:
-		l := &leafNode{
-			page: rootPage,
-		}
-		keys, vals, rightPage := l.page.FetchLeaf()
-		l.keys = keys
-		l.values = vals
-		if rightPage != nil {
-			l.right = &leafNode{page: rightPage}
-		}
-		return &BTree{
-			root: l,
-		}
-	case storage.INTERIOR_NODE:
-		i := &interiorNode{
-			page: rootPage,
-		}
-		keys, _ := i.page.FetchInterior()
-		i.keys = keys
-		return &BTree{
-			root: i,
+	t := newTree()
+	t.root = newNode(t, storage.GetPageNumber(number))
+	t.root.load()
+	t.counted = storesCounts(t.root.Page())
+	return t
+}
+
+/*
+SetFillFactor sets how full a split leaves the left node, as a fraction of a page.
+It is clamped between 0.5 (split in the middle) and 0.75. The right node
+gets what's left of a full page so anything more would leave it under
+a quarter full, and splits would keep making nearly empty right nodes.
+
+Inserts past the last key in the tree, like row IDs from OP_NEW_ROW_ID,
+always pack the left node as full as possible. Nothing will ever be inserted
+into it again so leaving room would only waste space.
+
+It isn't stored in the database, a fetched tree splits in the middle
+until it's set again. Set it before the tree is shared between goroutines.
+*/
+func (t *BTree) SetFillFactor(f float64) {
+	if f < 0.5 {
+		f = 0.5
+	}
+	if f > max_fill_factor {
+		f = max_fill_factor
+	}
+	t.fillFactor = f
+}
+
+/*
+SetComparator sets how the tree orders its keys. The default is bytes.Compare.
+The comparator isn't stored in the database, a tree has to be given
+the same one every time it's fetched or it will look in the wrong places.
+Like the fill factor it has to be set before the tree is shared between goroutines.
+*/
+func (t *BTree) SetComparator(cmp Comparator) {
+	t.comparator = cmp
+}
+
+//compare orders two keys with the tree's comparator
+func (t *BTree) compare(a, b []byte) int {
+	if t == nil || t.comparator == nil {
+		return bytes.Compare(a, b)
+	}
+	return t.comparator(a, b)
+}
+
+//encodeKey turns an int key into bytes that sort the same way
+func encodeKey(key int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(key))
+	return b
+}
+
+func decodeKey(key []byte) uint64 {
+	if len(key) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(key)
+}
+
+//splitTarget returns how many bytes a split should leave in the left node.
+//appending is set when the insert that caused the split is past the last key.
+//Unless it is the right node keeps at least a quarter of a page.
+func (t *BTree) splitTarget(sizes []int, appending bool) int {
+	switch {
+	case appending:
+		return pageCapacity
+	case t == nil || t.fillFactor == 0:
+		return halfOf(sizes)
+	}
+	target := int(t.fillFactor * float64(pageCapacity))
+	if most := sumOf(sizes) - pageCapacity/4; target > most {
+		target = most
+	}
+	return target
+}
+
+//Insert adds a value, replacing the old one if the key is already there
+func (t *BTree) Insert(key int, value []byte) error {
+	return t.InsertKey(encodeKey(key), value)
+}
+
+//InsertKey adds a value under a byte string key, replacing the old one if the key is already there
+func (t *BTree) InsertKey(key []byte, value []byte) error {
+	return t.InsertOr(key, value, CONFLICT_REPLACE)
+}
+
+//InsertOr adds a value under a byte string key. on decides what happens if the key is already there.
+func (t *BTree) InsertOr(key []byte, value []byte, on Conflict) error {
+	if storage.LeafCellSize(key, value) > pageCapacity/4 {
+		return ErrValueTooLarge
+	}
+	w := t.latchPath(key, insertSafe(key, value))
+	defer w.release()
+	if on != CONFLICT_REPLACE {
+		if _, found := w.leaf().search(key); found {
+			if on == CONFLICT_FAIL {
+				return ErrKeyExists
+			}
+			return nil
 		}
 	}
+	t.insert(w, key, value)
 	return nil
 }
-func (t *BTree) Insert(key int, value []byte) {
-	newNode := t.root.insert(uint64(key), value)
-	if newNode != nil {
-		t.root = newNode
-		t.root.write()
+
+//Update replaces the value of a key that is already in the tree
+func (t *BTree) Update(key int, value []byte) error {
+	return t.UpdateKey(encodeKey(key), value)
+}
+
+//UpdateKey replaces the value of a byte string key. It returns ErrKeyNotFound if the key isn't there.
+func (t *BTree) UpdateKey(key []byte, value []byte) error {
+	if storage.LeafCellSize(key, value) > pageCapacity/4 {
+		return ErrValueTooLarge
+	}
+	w := t.latchPath(key, insertSafe(key, value))
+	defer w.release()
+	if _, found := w.leaf().search(key); !found {
+		return ErrKeyNotFound
+	}
+	t.insert(w, key, value)
+	return nil
+}
+
+//insert puts the value in the tree starting at the top of the latched path.
+//Only a root that is still latched can split.
+func (t *BTree) insert(w *writePath, key []byte, value []byte) {
+	k, right := w.top().insert(key, value, w.appending)
+	if right != nil {
+		t.growRoot(k, right)
+	}
+}
+
+//growRoot is called when the root splits.
+//The tree is known by its root page so the old root moves to a new page
+//and the root page becomes the parent of the two halves.
+func (t *BTree) growRoot(key []byte, right noder) {
+	left := t.root
+	rootPage := left.Page()
+	left.setPage(t.newPage(rootPage))
+	left.write()
+
+	root := &interiorNode{
+		keys:     [][]byte{key},
+		children: []noder{left, right},
+		pages:    []storage.Pager{left.Page(), right.Page()},
+		counts:   make([]uint64, 2),
+		page:     rootPage,
+		loaded:   true,
+		tree:     t,
 	}
+	root.recount(0)
+	root.recount(1)
+	root.write()
+	t.root = root
+	t.cached(left, root)
+	t.cached(right, root)
+}
+
+//Delete removes the key and returns false if it wasn't in the tree
+func (t *BTree) Delete(key int) bool {
+	return t.DeleteKey(encodeKey(key))
 }
 
-func (t *BTree) Delete(key int) {
-	t.root.delete(uint64(key))
+//DeleteKey removes a byte string key and returns false if it wasn't in the tree
+func (t *BTree) DeleteKey(key []byte) bool {
+	w := t.latchPath(key, deleteSafe(key))
+	defer w.release()
+	found := w.top().delete(key)
+	if w.rootHeld {
+		t.shrinkRoot()
+	}
+	return found
 }
 
-func (t *BTree) Get(key int) []byte {
-	return t.root.get(uint64(key))
+//shrinkRoot pulls the only child of an interior root up into the root page.
+//The root latch has to be held, then nobody else can get to the child.
+func (t *BTree) shrinkRoot() {
+	for {
+		root, ok := t.root.(*interiorNode)
+		if !ok || len(root.keys) > 0 {
+			return
+		}
+		child := root.child(0)
+		child.load()
+		t.free(child.Page())
+		child.setPage(root.page)
+		child.write()
+		t.root = child
+		t.uncached(child)
+	}
 }
 
+//Get returns the value of the key and false if it isn't in the tree
+func (t *BTree) Get(key int) ([]byte, bool) {
+	return t.GetKey(encodeKey(key))
+}
+
+func (t *BTree) GetKey(key []byte) ([]byte, bool) {
+	l := t.latchLeaf(key)
+	defer l.RUnlock()
+	return l.get(key)
+}
+
+//Print is for debugging, it mustn't run while the tree is being written
 func (t *BTree) Print() {
+	t.rootLatch.RLock()
+	defer t.rootLatch.RUnlock()
 	t.root._print()
 }
 
+/*
+The Cursor* methods drive a cursor that belongs to the tree.
+Use NewCursor for scans that shouldn't disturb each other.
+*/
+
 func (b *BTree) CursorData() []byte {
-	if b.cursor.node == nil {
-		return nil
-	}
-	data := b.cursor.node.getValueAtIndex(b.cursor.index)
-	return data
+	return b.cursor.Data()
 }
 
 func (b *BTree) CursorFront() {
-	b.cursor.node = b.root.getLeft()
+	b.cursor.First()
+}
+
+func (b *BTree) CursorLast() {
+	b.cursor.Last()
+}
+
+func (b *BTree) CursorSeek(key int) {
+	b.cursor.Seek(key)
+}
+
+func (b *BTree) CursorRange(lo, hi int) {
+	b.cursor.Range(lo, hi)
 }
 
 func (b *BTree) CursorAvailable() bool {
-	return b.cursor.node != nil
+	return b.cursor.Available()
 }
 
 func (b *BTree) CursorNext() {
-	b.cursor.index++
-	if b.cursor.index >= len(b.cursor.node.values) {
-		b.cursor.node = b.cursor.node.right
-		b.cursor.index = 0
-	}
+	b.cursor.Next()
+}
 
+func (b *BTree) CursorPrev() {
+	b.cursor.Prev()
 }
 
 func (b *BTree) CursorKey() uint64 {
-	if b.cursor.node == nil {
-		return 0
-	}
-	return b.cursor.node.getKeyAtIndex(b.cursor.index)
+	return b.cursor.Key()
+}
+
+func (b *BTree) CursorKeyBytes() []byte {
+	return b.cursor.KeyBytes()
 }
 
+//LastKey returns the largest key in the tree or 0 if it's empty
 func (b *BTree) LastKey() int {
-	return int(b.root.getRight().page.NumberOfKeys())
+	last, _ := b.lastKey()
+	return int(decodeKey(last))
+}
+
+func (b *BTree) lastKey() ([]byte, bool) {
+	l := readDown(b.latchRoot(), func(i *interiorNode) int {
+		return len(i.pages) - 1
+	})
+	defer l.RUnlock()
+	if len(l.keys) == 0 {
+		return nil, false
+	}
+	return l.keys[len(l.keys)-1], true
 }
 
 type noder interface {
-	insert(key uint64, value []byte) *interiorNode
-	delete(uint64)
-	get(uint64) []byte
+	insert(key []byte, value []byte, appending bool) ([]byte, noder) //returns the promoted key and new right sibling on a split
+	delete([]byte) bool
 	Page() storage.Pager
-	Keys() []uint64 //only capitalized because nodes have a field keys
+	setPage(storage.Pager)
+	Keys() [][]byte //only capitalized because nodes have a field keys
+	load()
+	underflows() bool
 	write()
-	getLeft() *leafNode  //get left most child
-	getRight() *leafNode //get right most child
-	_print()             //debugging only
+	getLeft() *leafNode //get left most child
+	rows() uint64       //keys under the node, interior nodes only know if the tree keeps counts
+	_print()            //debugging only
+	entry() *cacheEntry //the node's place in the cache, see cache.go
+
+	//the node's latch, see latch.go
+	RLock()
+	RUnlock()
+	Lock()
+	Unlock()
+	TryLock() bool
+}
+
+func leafFits(keys [][]byte, values [][]byte) bool {
+	return storage.LeafSize(keys, values) <= pageCapacity
+}
+
+func (t *BTree) interiorFits(keys [][]byte) bool {
+	return t.interiorSize(keys) <= pageCapacity
+}
+
+/*
+Underflow is measured without the prefix the keys share. A split or a rebalance
+measures cells against the prefix of all the keys it cuts, each half can then
+share a longer one and take up less of its page. Measured without prefixes
+a half is never smaller than the split thought, so it can't underflow right away.
+*/
+
+//leafCells is what a leaf's cells would take up if they shared no prefix
+func leafCells(keys [][]byte, values [][]byte) int {
+	size := 0
+	for x, k := range keys {
+		size += storage.LeafCellSize(k, values[x])
+	}
+	return size
+}
+
+//interiorCells is interiorSize if the keys shared no prefix
+func (t *BTree) interiorCells(keys [][]byte) int {
+	size := t.interiorSize(nil)
+	for _, k := range keys {
+		size += t.interiorCellSize(k)
+	}
+	return size
+}
+
+//interiorSize is storage.InteriorSize plus the counts, if the tree keeps them
+func (t *BTree) interiorSize(keys [][]byte) int {
+	return storage.InteriorSize(keys) + (len(keys)+1)*t.countSize()
+}
+
+//interiorCellSize is storage.InteriorCellSize plus the count, if the tree keeps them
+func (t *BTree) interiorCellSize(key []byte) int {
+	return storage.InteriorCellSize(key) + t.countSize()
+}
+
+//countSize is what each child's count takes up on an interior page
+func (t *BTree) countSize() int {
+	if t == nil || !t.counted {
+		return 0
+	}
+	return storage.COUNT_SIZE
+}
+
+//leafCellSizes returns what each cell costs on a page holding all of them, without the prefix they share.
+//Cutting the cells can only make the prefix longer, so any run of them fits if its sizes add up to room.
+func leafCellSizes(keys [][]byte, values [][]byte) ([]int, int) {
+	prefix := len(storage.CommonPrefix(keys))
+	sizes := make([]int, len(keys))
+	for x, k := range keys {
+		sizes[x] = storage.LeafCellSize(k[prefix:], values[x])
+	}
+	return sizes, pageCapacity - prefix
+}
+
+//interiorCellSizes is leafCellSizes for interior nodes
+func (t *BTree) interiorCellSizes(keys [][]byte) ([]int, int) {
+	prefix := len(storage.CommonPrefix(keys))
+	sizes := make([]int, len(keys))
+	for x, k := range keys {
+		sizes[x] = t.interiorCellSize(k[prefix:])
+	}
+	return sizes, pageCapacity - prefix
+}
+
+//splitIndex returns where to cut a node whose cells have the given sizes
+//so the left side ends up with about target bytes and the right side still fits in room.
+//Both sides get at least one cell.
+func splitIndex(sizes []int, target int, room int) int {
+	total := sumOf(sizes)
+	if target > room {
+		target = room
+	}
+	left := 0
+	for i, s := range sizes {
+		if i > 0 && left+s > target && total-left <= room {
+			return i
+		}
+		left += s
+	}
+	return len(sizes) - 1
+}
+
+//separator returns the shortest key that is larger than left and no larger than right.
+//Interior nodes only need keys that tell their children apart, short ones leave room for more.
+//It only knows bytewise order, with a comparator right is returned as it is.
+func (t *BTree) separator(left []byte, right []byte) []byte {
+	if t != nil && t.comparator != nil {
+		return right
+	}
+	n := 0
+	for n < len(left) && left[n] == right[n] {
+		n++
+	}
+	return append([]byte{}, right[:n+1]...)
+}
+
+//halfOf returns the target for splitIndex that spreads the cells evenly
+func halfOf(sizes []int) int {
+	return sumOf(sizes) / 2
+}
+
+func sumOf(sizes []int) int {
+	total := 0
+	for _, s := range sizes {
+		total += s
+	}
+	return total
 }
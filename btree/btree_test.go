@@ -0,0 +1,1529 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/MattParker89/seaquell/storage"
+	"math"
+	"math/big"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_NewIn_Temp(t *testing.T) {
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	for k := 1; k < 4; k++ {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	for k := 1; k < 4; k++ {
+		if v, found := tree.Get(k); !found || !bytes.Equal(v, []byte{byte(k)}) {
+			t.Errorf("Key %d: Expected %v; got %v", k, []byte{byte(k)}, v)
+		}
+	}
+}
+
+func openTestDB(t *testing.T, name string) (*BTree, func()) {
+	s, err := storage.Open(name, storage.MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Fetch(0), s.Close
+}
+
+func treeKeys(tree *BTree) []uint64 {
+	var keys []uint64
+	for tree.CursorFront(); tree.CursorAvailable(); tree.CursorNext() {
+		keys = append(keys, tree.CursorKey())
+	}
+	return keys
+}
+
+//smallPages makes nodes split after a few hundred bytes so tests get deep trees quickly
+func smallPages(t *testing.T) {
+	old := pageCapacity
+	pageCapacity = 512
+	t.Cleanup(func() { pageCapacity = old })
+}
+
+func Test_Delete_Rebalance_Persist(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	tree, closeDB := openTestDB(t, name)
+
+	numberOfKeys := 2000
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	deleted := map[int]bool{}
+	for _, k := range r.Perm(numberOfKeys)[:numberOfKeys*3/4] {
+		if !tree.Delete(k) {
+			t.Errorf("Expected key %d to be deleted", k)
+		}
+		deleted[k] = true
+	}
+	if tree.Delete(numberOfKeys + 1) {
+		t.Error("Deleted a key that was never inserted")
+	}
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+	closeDB()
+
+	tree, closeDB = openTestDB(t, name)
+	defer closeDB()
+	var expected []uint64
+	for k := 0; k < numberOfKeys; k++ {
+		if !deleted[k] {
+			expected = append(expected, uint64(k))
+			if v, found := tree.Get(k); !found || !bytes.Equal(v, []byte{byte(k)}) {
+				t.Errorf("Key %d: Expected %v; got %v", k, []byte{byte(k)}, v)
+			}
+		}
+	}
+	keys := treeKeys(tree)
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %d keys after reopening; got %d", len(expected), len(keys))
+	}
+	for i := range keys {
+		if keys[i] != expected[i] {
+			t.Fatalf("Expected keys %v; got %v", expected, keys)
+		}
+	}
+
+	//everything is gone and the pages are reused
+	for _, k := range expected {
+		tree.Delete(int(k))
+	}
+	if _, ok := tree.root.(*leafNode); !ok || len(treeKeys(tree)) != 0 {
+		t.Error("Expected an empty leaf root")
+	}
+}
+
+func Test_Get_Insert_Conflicts(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	if _, found := tree.Get(1); found {
+		t.Error("Found a key in an empty tree")
+	}
+	numberOfKeys := 200
+	for k := 0; k < numberOfKeys; k += 2 {
+		tree.Insert(k, []byte{1})
+	}
+	if v, found := tree.Get(51); found {
+		t.Errorf("Expected key 51 to be missing; got %v", v)
+	}
+
+	//replacing with bigger values splits leaves without duplicating keys
+	for k := 0; k < numberOfKeys; k += 2 {
+		if err := tree.Insert(k, []byte{2, 2, 2, 2, 2, 2, 2, 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if keys := treeKeys(tree); len(keys) != numberOfKeys/2 {
+		t.Errorf("Expected %d keys after replacing; got %d", numberOfKeys/2, len(keys))
+	}
+
+	if err := tree.InsertOr(encodeKey(10), []byte{3}, CONFLICT_FAIL); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists; got %v", err)
+	}
+	if err := tree.InsertOr(encodeKey(10), []byte{3}, CONFLICT_IGNORE); err != nil {
+		t.Errorf("Expected an ignored conflict; got %v", err)
+	}
+	if v, _ := tree.Get(10); v[0] != 2 {
+		t.Errorf("Expected the old value to be kept; got %v", v)
+	}
+	if err := tree.InsertOr(encodeKey(11), []byte{3}, CONFLICT_FAIL); err != nil {
+		t.Errorf("Expected a new key to be inserted; got %v", err)
+	}
+
+	if err := tree.Update(13, []byte{4}); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound; got %v", err)
+	}
+	if err := tree.Update(12, []byte{4}); err != nil {
+		t.Fatal(err)
+	}
+	if v, found := tree.Get(12); !found || !bytes.Equal(v, []byte{4}) {
+		t.Errorf("Expected the updated value; got %v", v)
+	}
+}
+
+func Test_Byte_Keys_Comparator(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	tree, closeDB := openTestDB(t, name)
+	caseless := func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	}
+	tree.SetComparator(caseless)
+
+	//keys of different lengths in mixed case so the default order would be wrong
+	numberOfKeys := 500
+	key := func(k int) []byte {
+		s := fmt.Sprintf("name %d %s", k, strings.Repeat("x", k%20))
+		if k%2 == 1 {
+			s = strings.ToUpper(s)
+		}
+		return []byte(s)
+	}
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(numberOfKeys) {
+		if err := tree.InsertKey(key(k), []byte{byte(k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closeDB()
+
+	tree, closeDB = openTestDB(t, name)
+	defer closeDB()
+	tree.SetComparator(caseless)
+	if v, _ := tree.GetKey([]byte("NAME 10 XXXXXXXXXX")); !bytes.Equal(v, []byte{10}) {
+		t.Errorf("Expected a caseless lookup to find key 10; got %v", v)
+	}
+
+	var keys [][]byte
+	for tree.CursorFront(); tree.CursorAvailable(); tree.CursorNext() {
+		keys = append(keys, tree.CursorKeyBytes())
+	}
+	if len(keys) != numberOfKeys {
+		t.Fatalf("Expected %d keys; got %d", numberOfKeys, len(keys))
+	}
+	for i := 1; i < len(keys); i++ {
+		if caseless(keys[i-1], keys[i]) >= 0 {
+			t.Fatalf("Keys out of order: %q before %q", keys[i-1], keys[i])
+		}
+	}
+
+	c := tree.NewCursor()
+	var count int
+	for c.RangeKeys([]byte("name 2"), []byte("name 3")); c.Available(); c.Next() {
+		if !bytes.HasPrefix(bytes.ToLower(c.KeyBytes()), []byte("name 2")) {
+			t.Errorf("Key %q is outside the range", c.KeyBytes())
+		}
+		count++
+	}
+	//2, 20-29 and 200-299
+	if count != 111 {
+		t.Errorf("Expected 111 keys in the range; got %d", count)
+	}
+}
+
+func Test_Bulk_Load(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	tree, closeDB := openTestDB(t, name)
+
+	loader, err := tree.NewLoader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberOfKeys := 3000
+	for k := 0; k < numberOfKeys; k++ {
+		if err := loader.Add(encodeKey(k), []byte{byte(k)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loader.Add(encodeKey(5), []byte{5}); err != ErrNotSorted {
+		t.Errorf("Expected ErrNotSorted; got %v", err)
+	}
+	if err := loader.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if fill := averageLeafFill(tree); fill < 0.9 {
+		t.Errorf("Expected loaded leaves to be packed; average fill is %.2f", fill)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+	if _, err := tree.NewLoader(); err != ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty; got %v", err)
+	}
+	closeDB()
+
+	tree, closeDB = openTestDB(t, name)
+	defer closeDB()
+	keys := treeKeys(tree)
+	if len(keys) != numberOfKeys {
+		t.Fatalf("Expected %d keys after reopening; got %d", numberOfKeys, len(keys))
+	}
+	for i, k := range keys {
+		if k != uint64(i) {
+			t.Fatalf("Expected key %d; got %d", i, k)
+		}
+	}
+	for tree.CursorLast(); tree.CursorAvailable(); tree.CursorPrev() {
+		numberOfKeys--
+	}
+	if numberOfKeys != 0 {
+		t.Errorf("Walking backwards missed %d keys", numberOfKeys)
+	}
+
+	//the loaded tree takes inserts and deletes like any other
+	tree.Insert(10000, []byte{1})
+	for k := 0; k < 3000; k += 2 {
+		tree.Delete(k)
+	}
+	if v, _ := tree.Get(1001); !bytes.Equal(v, []byte{1001 % 256}) {
+		t.Errorf("Expected %v; got %v", []byte{1001 % 256}, v)
+	}
+	if keys := treeKeys(tree); len(keys) != 1501 || keys[len(keys)-1] != 10000 {
+		t.Errorf("Expected 1501 keys ending in 10000; got %d", len(keys))
+	}
+}
+
+func Test_Bulk_Load_Small(t *testing.T) {
+	for _, numberOfKeys := range []int{1, 2, 30, 31, 32, 33} {
+		s := storage.CreateTemp()
+		tree := NewIn(s)
+		loader, _ := tree.NewLoader()
+		for k := 0; k < numberOfKeys; k++ {
+			loader.Add(encodeKey(k), make([]byte, 100))
+		}
+		loader.Finish()
+		if keys := treeKeys(tree); len(keys) != numberOfKeys {
+			t.Errorf("Loaded %d keys; got %d back", numberOfKeys, len(keys))
+		}
+		s.Close()
+	}
+}
+
+func Test_Bulk_Load_Cancel(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	load := func() *Loader {
+		loader, err := tree.NewLoader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := 0; k < 2000; k++ {
+			loader.Add(encodeKey(k), []byte{byte(k)})
+		}
+		return loader
+	}
+	loader := load()
+	cancelled := map[uint64]bool{}
+	for _, p := range loader.written {
+		cancelled[p.Offset()] = true
+	}
+	loader.Cancel()
+	if keys := treeKeys(tree); len(keys) != 0 {
+		t.Fatalf("Expected the tree to stay empty; got %d keys", len(keys))
+	}
+
+	//the tree can be loaded again and the load reuses the pages that were freed
+	if err := load().Finish(); err != nil {
+		t.Fatal(err)
+	}
+	root := tree.root.Page()
+	seen := map[uint64]bool{}
+	walkPages(root, root.Offset(), seen, nil)
+	for offset := range cancelled {
+		if !seen[offset] {
+			t.Errorf("Expected page %d of the cancelled load to be used again", offset)
+		}
+	}
+	if keys := treeKeys(tree); len(keys) != 2000 {
+		t.Errorf("Expected 2000 keys; got %d", len(keys))
+	}
+}
+
+func Test_Split_By_Size(t *testing.T) {
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	//small values pack many keys into a leaf, big ones only a few
+	value := make([]byte, 10)
+	numberOfKeys := 1000
+	for k := 0; k < numberOfKeys; k++ {
+		tree.Insert(k, value)
+	}
+	if _, ok := tree.root.(*leafNode); !ok {
+		t.Fatalf("Expected %d small values to fit in one leaf", numberOfKeys)
+	}
+
+	value = make([]byte, 2000)
+	for k := numberOfKeys; k < numberOfKeys+100; k++ {
+		tree.Insert(k, value)
+	}
+	root, ok := tree.root.(*interiorNode)
+	if !ok {
+		t.Fatal("Expected the root to split")
+	}
+	for x := range root.pages {
+		l := root.child(x).(*leafNode)
+		l.load()
+		if size := storage.LeafSize(l.keys, l.values); size > storage.PAGE_CAPACITY {
+			t.Errorf("Leaf %d holds %d bytes; the page only has %d", x, size, storage.PAGE_CAPACITY)
+		}
+	}
+
+	if err := tree.Insert(numberOfKeys+100, make([]byte, storage.PAGE_CAPACITY)); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge; got %v", err)
+	}
+}
+
+//averageLeafFill returns how full the leaves are on average as a fraction of a page
+func averageLeafFill(tree *BTree) float64 {
+	var total float64
+	var leaves int
+	for l := tree.root.getLeft(); l != nil; {
+		l.load()
+		total += float64(storage.LeafSize(l.keys, l.values)) / float64(pageCapacity)
+		leaves++
+		if l.right == nil {
+			break
+		}
+		l = &leafNode{page: l.right, tree: tree}
+	}
+	return total / float64(leaves)
+}
+
+func Test_Append_Packs_Leaves(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+
+	sequential := NewIn(s)
+	for k := 1; k <= 2000; k++ {
+		sequential.Insert(sequential.LastKey()+1, []byte{byte(k)})
+	}
+	if sequential.LastKey() != 2000 {
+		t.Errorf("Expected the last key to be 2000; got %d", sequential.LastKey())
+	}
+	if fill := averageLeafFill(sequential); fill < 0.9 {
+		t.Errorf("Expected appends to pack leaves; average fill is %.2f", fill)
+	}
+
+	//a fill factor past 0.75 would leave right nodes under a quarter full
+	random := NewIn(s)
+	random.SetFillFactor(1)
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(2000) {
+		random.Insert(k+1, []byte{byte(k)})
+	}
+	if keys := treeKeys(random); len(keys) != 2000 {
+		t.Errorf("Expected 2000 keys; got %d", len(keys))
+	}
+	if err := random.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	//the key at the end makes every insert a split in the middle of the tree,
+	//the left halves are never inserted into again so they keep the fill factor.
+	//The values are large so the shorter prefix of a left half barely changes its size,
+	//whole cells still leave it a little under.
+	filled := NewIn(s)
+	filled.SetFillFactor(0.75)
+	filled.Insert(math.MaxInt32, []byte{0})
+	for k := 1; k <= 2000; k++ {
+		filled.Insert(k, make([]byte, 38))
+	}
+	if fill := averageLeafFill(filled); math.Abs(fill-0.75) > 0.05 {
+		t.Errorf("Expected leaves to be filled to 0.75; average fill is %.2f", fill)
+	}
+	if err := filled.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Cursor_Seek_Range(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	//only even keys
+	for k := 0; k < 2000; k += 2 {
+		tree.Insert(k, []byte{byte(k)})
+	}
+
+	tree.CursorSeek(501)
+	if !tree.CursorAvailable() || tree.CursorKey() != 502 {
+		t.Errorf("Expected seek to land on 502; got %d", tree.CursorKey())
+	}
+	tree.CursorSeek(600)
+	if tree.CursorKey() != 600 {
+		t.Errorf("Expected seek to land on 600; got %d", tree.CursorKey())
+	}
+	tree.CursorSeek(5000)
+	if tree.CursorAvailable() {
+		t.Error("Expected nothing after the last key")
+	}
+
+	var keys []uint64
+	for tree.CursorRange(101, 151); tree.CursorAvailable(); tree.CursorNext() {
+		keys = append(keys, tree.CursorKey())
+	}
+	if len(keys) != 25 || keys[0] != 102 || keys[len(keys)-1] != 150 {
+		t.Errorf("Expected the 25 keys from 102 to 150; got %v", keys)
+	}
+}
+
+func Test_Cursor_Backwards(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	tree.CursorLast()
+	if tree.CursorAvailable() {
+		t.Error("Expected an empty tree to have no last key")
+	}
+
+	numberOfKeys := 2000
+	for _, k := range rand.New(rand.NewSource(1)).Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k)})
+	}
+
+	expected := numberOfKeys - 1
+	for tree.CursorLast(); tree.CursorAvailable(); tree.CursorPrev() {
+		if tree.CursorKey() != uint64(expected) {
+			t.Fatalf("Expected %d; got %d", expected, tree.CursorKey())
+		}
+		expected--
+	}
+	if expected != -1 {
+		t.Errorf("Expected to walk back over every key; stopped before %d", expected)
+	}
+
+	//back and forth across a leaf boundary
+	tree.CursorSeek(1000)
+	for i := 0; i < 100; i++ {
+		tree.CursorNext()
+	}
+	for i := 0; i < 100; i++ {
+		tree.CursorPrev()
+	}
+	if tree.CursorKey() != 1000 {
+		t.Errorf("Expected to end up back on 1000; got %d", tree.CursorKey())
+	}
+
+	tree.CursorRange(10, 20)
+	tree.CursorPrev()
+	if tree.CursorAvailable() {
+		t.Error("Expected the range to end below 10")
+	}
+}
+
+func Test_Independent_Cursors(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	for k := 0; k < 1000; k++ {
+		tree.Insert(k, []byte{byte(k)})
+	}
+
+	//a self join: every pair (a, b) with b = a + 500
+	outer := tree.NewCursor()
+	inner := tree.NewCursor()
+	pairs := 0
+	for outer.First(); outer.Available(); outer.Next() {
+		inner.Seek(int(outer.Key()) + 500)
+		if inner.Available() && inner.Key() == outer.Key()+500 {
+			pairs++
+		}
+	}
+	if pairs != 500 {
+		t.Errorf("Expected 500 pairs; got %d", pairs)
+	}
+
+	//changes under a cursor don't move it to the wrong row
+	c := tree.NewCursor()
+	c.Seek(100)
+	for k := 0; k < 100; k++ {
+		tree.Delete(k)
+	}
+	tree.Delete(101)
+	if !bytes.Equal(c.Data(), []byte{100}) {
+		t.Errorf("Expected the cursor to still read 100; got %v", c.Data())
+	}
+	c.Next()
+	if c.Key() != 102 {
+		t.Errorf("Expected the next key to be 102; got %d", c.Key())
+	}
+	c.Prev()
+	tree.Delete(100)
+	c.Next()
+	if c.Key() != 102 {
+		t.Errorf("Expected a deleted key to move on to 102; got %d", c.Key())
+	}
+}
+
+func Test_Cursors_Concurrently(t *testing.T) {
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	for k := 0; k < 500; k++ {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	done := make(chan int)
+	for g := 0; g < 4; g++ {
+		go func() {
+			count := 0
+			c := tree.NewCursor()
+			for c.First(); c.Available(); c.Next() {
+				count++
+			}
+			done <- count
+		}()
+	}
+	for g := 0; g < 4; g++ {
+		if count := <-done; count != 500 {
+			t.Errorf("Expected every cursor to see 500 keys; got %d", count)
+		}
+	}
+}
+
+//run with -race
+func Test_Readers_And_Writers_Concurrently(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	//even keys are never touched, writers only add and remove odd ones
+	numberOfKeys := 2000
+	for k := 0; k < numberOfKeys; k += 2 {
+		tree.Insert(k, []byte{byte(k)})
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			for _, k := range r.Perm(numberOfKeys / 4) {
+				k = (k*4 + w*2) + 1
+				tree.Insert(k, []byte{byte(k)})
+				if k%3 == 0 {
+					tree.Delete(k)
+				}
+			}
+		}(w)
+	}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for k := g * 2; k < numberOfKeys; k += 8 {
+				if v, found := tree.Get(k); !found || v[0] != byte(k) {
+					t.Errorf("Key %d: Expected %v; got %v", k, byte(k), v)
+				}
+			}
+			evens := 0
+			last := -1
+			c := tree.NewCursor()
+			next, start := c.Next, c.First
+			if g%2 == 1 {
+				next, start, last = c.Prev, c.Last, numberOfKeys
+			}
+			for start(); c.Available(); next() {
+				k := int(c.Key())
+				if (g%2 == 0 && k <= last) || (g%2 == 1 && k >= last) {
+					t.Errorf("Cursor went from %d to %d", last, k)
+				}
+				last = k
+				if k%2 == 0 {
+					evens++
+				}
+			}
+			if evens != numberOfKeys/2 {
+				t.Errorf("Expected a cursor to see %d even keys; got %d", numberOfKeys/2, evens)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	for k := 1; k < numberOfKeys; k += 2 {
+		if _, found := tree.Get(k); found == (k%3 == 0) {
+			t.Errorf("Key %d: wrong state after the writers finished", k)
+		}
+	}
+}
+
+func Test_Copy_On_Write(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := storage.Open(name, storage.MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := FetchCOW(0)
+
+	numberOfKeys := 1000
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	first, err := tree.Commit()
+	if err != nil || first != 2 {
+		t.Fatalf("Expected version 2; got %d %v", first, err)
+	}
+	if v, _ := tree.Commit(); v != first {
+		t.Errorf("Committing nothing made version %d", v)
+	}
+	snap, err := tree.Snapshot(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//readers of the snapshot don't see the writer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, k := range r.Perm(numberOfKeys)[:numberOfKeys/2] {
+			tree.Delete(k)
+		}
+		for k := numberOfKeys; k < numberOfKeys*2; k++ {
+			tree.Insert(k, []byte{byte(k)})
+		}
+	}()
+	for k := 0; k < numberOfKeys*2; k++ {
+		if _, found := snap.Get(k); found != (k < numberOfKeys) {
+			t.Errorf("Snapshot key %d: Expected found %v", k, k < numberOfKeys)
+		}
+	}
+	wg.Wait()
+
+	if err := tree.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if keys := treeKeys(tree); len(keys) != numberOfKeys {
+		t.Errorf("Expected %d keys after the rollback; got %d", numberOfKeys, len(keys))
+	}
+	for k := 0; k < numberOfKeys; k += 2 {
+		tree.Delete(k)
+	}
+	second, _ := tree.Commit()
+	s.Close()
+
+	s, err = storage.Open(name, storage.MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tree = FetchCOW(0)
+	if versions := tree.Versions(); fmt.Sprint(versions) != fmt.Sprint([]uint64{1, first, second}) {
+		t.Errorf("Expected versions %v; got %v", []uint64{1, first, second}, versions)
+	}
+	snap, _ = tree.Snapshot(first)
+	c := snap.NewCursor()
+	count := 0
+	for c.First(); c.Available(); c.Next() {
+		if int(c.Key()) != count {
+			t.Fatalf("Expected key %d in version %d; got %d", count, first, c.Key())
+		}
+		count++
+	}
+	if count != numberOfKeys {
+		t.Errorf("Expected %d keys in version %d; got %d", numberOfKeys, first, count)
+	}
+
+	if err := tree.Forget(second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Snapshot(first); err != ErrNoVersion {
+		t.Errorf("Expected ErrNoVersion; got %v", err)
+	}
+	//the freed pages get used again
+	for k := numberOfKeys; k < numberOfKeys*2; k++ {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	snap, _ = tree.Snapshot(second)
+	for k := 0; k < numberOfKeys*2; k++ {
+		if _, found := snap.Get(k); found != (k < numberOfKeys && k%2 == 1) {
+			t.Errorf("Key %d: wrong state in version %d", k, second)
+		}
+		if v, found := tree.Get(k); found != (k >= numberOfKeys || k%2 == 1) || (found && v[0] != byte(k)) {
+			t.Errorf("Key %d: wrong state in the tree", k)
+		}
+	}
+}
+
+func Test_Prefixes_And_Separators(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	tree, closeDB := openTestDB(t, name)
+
+	key := func(k int) []byte {
+		return []byte(fmt.Sprintf("customers/%06d/orders", k))
+	}
+	numberOfKeys := 2000
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(numberOfKeys) {
+		tree.InsertKey(key(k), []byte{byte(k)})
+	}
+	//the shared prefix is stored once so a leaf holds more than its uncompressed size allows
+	uncompressed := storage.LeafCellSize(key(0), []byte{0})
+	leaves, interiors := 0, 0
+	var walk func(n noder)
+	walk = func(n noder) {
+		n.load()
+		switch n := n.(type) {
+		case *leafNode:
+			leaves++
+		case *interiorNode:
+			interiors++
+			for _, k := range n.keys {
+				if len(k) >= len(key(0)) {
+					t.Errorf("Expected separators shorter than the keys; got %q", k)
+				}
+			}
+			for x := range n.children {
+				walk(n.child(x))
+			}
+		}
+	}
+	walk(tree.root)
+	if perLeaf := numberOfKeys / leaves; perLeaf*uncompressed <= pageCapacity/2 {
+		t.Errorf("Expected leaves to hold more than %d keys; got %d", pageCapacity/2/uncompressed, perLeaf)
+	}
+	for k := 0; k < numberOfKeys; k += 3 {
+		tree.DeleteKey(key(k))
+	}
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+	closeDB()
+
+	tree, closeDB = openTestDB(t, name)
+	defer closeDB()
+	for k := 0; k < numberOfKeys; k++ {
+		if v, found := tree.GetKey(key(k)); found != (k%3 != 0) || (found && v[0] != byte(k)) {
+			t.Errorf("Key %q: wrong state after reopening", key(k))
+		}
+	}
+}
+
+func Test_Verify(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		for op := 0; op < 200; op++ {
+			k := r.Intn(2000)
+			if r.Intn(3) == 0 {
+				tree.Delete(k)
+			} else {
+				tree.Insert(k, make([]byte, 1+r.Intn(20)))
+			}
+		}
+		if err := tree.Verify(); err != nil {
+			t.Fatalf("Round %d: %v", round, err)
+		}
+	}
+
+	//keys with and without a long shared prefix, the halves of a split
+	//can share more of it than the node did and shrink on their pages
+	prefixed := NewIn(s)
+	url := "https://example.com/" + strings.Repeat("x", 40) + "/"
+	for op := 0; op < 1500; op++ {
+		k := fmt.Sprintf("%06d", r.Intn(100000))
+		if r.Intn(2) == 0 {
+			k = url + k
+		}
+		if r.Intn(3) == 0 {
+			prefixed.DeleteKey([]byte(k))
+		} else {
+			prefixed.InsertKey([]byte(k), make([]byte, r.Intn(20)))
+		}
+		if err := prefixed.Verify(); err != nil {
+			t.Fatalf("Op %d: %v", op, err)
+		}
+	}
+
+	//swap the first leaf's keys and point it at the wrong sibling
+	l := readDown(tree.latchRoot(), func(*interiorNode) int { return 0 })
+	l.keys[0], l.keys[1] = l.keys[1], l.keys[0]
+	right := l.right
+	l.right = nil
+	l.RUnlock()
+	err := tree.Verify()
+	if err == nil {
+		t.Fatal("Expected Verify to find the broken leaf")
+	}
+	for _, problem := range []string{"isn't larger than the one before it", "right pointer"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in %v", problem, err)
+		}
+	}
+	l.keys[0], l.keys[1] = l.keys[1], l.keys[0]
+	l.right = right
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	if stats := tree.Stats(); stats.Depth != 1 || stats.Leaves != 1 || stats.Keys != 0 || stats.Fill != 0 {
+		t.Errorf("Expected an empty leaf; got %+v", stats)
+	}
+	numberOfKeys := 2000
+	for _, k := range rand.New(rand.NewSource(1)).Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k), 0})
+	}
+	stats := tree.Stats()
+	if stats.Keys != numberOfKeys || stats.PayloadBytes != numberOfKeys*(8+2) {
+		t.Errorf("Expected %d keys and %d bytes; got %+v", numberOfKeys, numberOfKeys*10, stats)
+	}
+	if stats.Depth < 3 || stats.Interiors == 0 || stats.Leaves <= stats.Interiors {
+		t.Errorf("Expected a deep tree; got %+v", stats)
+	}
+	if stats.Fill < 0.25 || stats.Fill > 1 {
+		t.Errorf("Expected nodes between a quarter full and full; got %+v", stats)
+	}
+}
+
+func Test_Iterators(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+
+	numberOfKeys := 1000
+	for _, k := range rand.New(rand.NewSource(1)).Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	expected := uint64(0)
+	for k, v := range tree.All() {
+		if k != expected || v[0] != byte(k) {
+			t.Fatalf("Expected key %d; got %d %v", expected, k, v)
+		}
+		expected++
+	}
+	if expected != uint64(numberOfKeys) {
+		t.Errorf("Expected %d keys; got %d", numberOfKeys, expected)
+	}
+	for k := range tree.Backward() {
+		expected--
+		if k != expected {
+			t.Fatalf("Expected key %d going backwards; got %d", expected, k)
+		}
+	}
+
+	var keys []uint64
+	var rangeErr error
+	for k := range tree.Range(100, 200, &rangeErr) {
+		if k == 150 {
+			break
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) != 50 || keys[0] != 100 || keys[49] != 149 {
+		t.Errorf("Expected 100 to 149; got %v", keys)
+	}
+	if rangeErr != nil {
+		t.Errorf("Expected no error; got %v", rangeErr)
+	}
+
+	//two runs of one loop at the same time, only the one that fails gets the error
+	tree.InsertKey([]byte("not an int"), nil)
+	var allErr, cutErr error
+	all := tree.All()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range all {
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range tree.All(&cutErr) {
+			break
+		}
+	}()
+	wg.Wait()
+	for range tree.All(&allErr) {
+	}
+	if allErr != ErrNotIntKey {
+		t.Errorf("Expected ErrNotIntKey; got %v", allErr)
+	}
+	if cutErr != nil || rangeErr != nil {
+		t.Errorf("Expected the other loops to have no error; got %v and %v", cutErr, rangeErr)
+	}
+}
+
+//inMemory counts the nodes reachable from the root without reading any pages
+func inMemory(n noder) int {
+	count := 1
+	if i, ok := n.(*interiorNode); ok {
+		for _, c := range i.children {
+			if c != nil {
+				count += inMemory(c)
+			}
+		}
+	}
+	return count
+}
+
+//run with -race
+func Test_Node_Cache(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	tree.SetCacheSize(20)
+
+	numberOfKeys := 5000
+	for _, k := range rand.New(rand.NewSource(1)).Perm(numberOfKeys) {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	stats := tree.Stats()
+	if nodes := inMemory(tree.root); nodes > 20+2*stats.Depth {
+		t.Errorf("Expected about 20 nodes in memory; got %d of %d", nodes, stats.Interiors+stats.Leaves)
+	}
+
+	//evictions leave the version alone, only a cursor on a dropped node seeks again
+	version := tree.version
+	c := tree.NewCursor()
+	c.Seek(100)
+	for k := 0; k < numberOfKeys; k += 50 {
+		tree.Get(k)
+	}
+	if tree.version != version {
+		t.Errorf("Expected reads to leave the version at %d; got %d", version, tree.version)
+	}
+	if !c.node.dropped.Load() {
+		t.Error("Expected the cursor's leaf to be evicted")
+	}
+	if c.Next(); c.Key() != 101 {
+		t.Errorf("Expected 101 after the cursor's leaf was evicted; got %d", c.Key())
+	}
+
+	//scans and writes work with nodes coming and going underneath them
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for k := 1; k < numberOfKeys; k += 2 {
+			tree.Delete(k)
+		}
+	}()
+	for g := 0; g < 2; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			evens, last := 0, -1
+			for k := range tree.All() {
+				if int(k) <= last {
+					t.Errorf("Scan went from %d to %d", last, k)
+				}
+				last = int(k)
+				if k%2 == 0 {
+					evens++
+				}
+			}
+			if evens != numberOfKeys/2 {
+				t.Errorf("Expected the scan to see %d even keys; got %d", numberOfKeys/2, evens)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := tree.Verify(); err != nil {
+		t.Error(err)
+	}
+	if nodes := inMemory(tree.root); nodes > 20+2*stats.Depth {
+		t.Errorf("Expected about 20 nodes in memory after scanning; got %d", nodes)
+	}
+	for k := 0; k < numberOfKeys; k++ {
+		if v, found := tree.Get(k); found != (k%2 == 0) || (found && v[0] != byte(k)) {
+			t.Errorf("Key %d: wrong state", k)
+		}
+	}
+}
+
+func Test_Drop(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+
+	pagesOf := func(tree *BTree) map[uint64]bool {
+		seen := map[uint64]bool{}
+		root := tree.root.Page()
+		walkPages(root, root.Offset(), seen, nil)
+		return seen
+	}
+	build := func() *BTree {
+		tree := NewIn(s)
+		for _, k := range rand.New(rand.NewSource(1)).Perm(2000) {
+			tree.Insert(k, []byte{byte(k)})
+		}
+		return tree
+	}
+	tree := build()
+	dropped := pagesOf(tree)
+	if len(dropped) < 10 {
+		t.Fatalf("Expected a deep tree; got %d pages", len(dropped))
+	}
+	tree.Drop()
+
+	//the same tree again fits in the pages that were freed
+	for offset := range pagesOf(build()) {
+		if !dropped[offset] {
+			t.Errorf("Expected page %d to come from the dropped tree", offset)
+		}
+	}
+
+	//a writer below the root holds its leaf until it's done, Drop waits for it
+	tree = build()
+	w := tree.latchPath(encodeKey(1000), insertSafe(encodeKey(1000), []byte{1}))
+	if w.rootHeld {
+		t.Fatal("Expected the writer to let go of the root")
+	}
+	done := make(chan bool)
+	go func() {
+		tree.Drop()
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Error("Expected Drop to wait for the writer")
+	default:
+	}
+	tree.insert(w, encodeKey(1000), []byte{1})
+	w.release()
+	<-done
+}
+
+func Test_Counts(t *testing.T) {
+	smallPages(t)
+	name := filepath.Join(t.TempDir(), "test.db")
+	tree, closeDB := openTestDB(t, name)
+	tree.KeepCounts()
+
+	present := map[int]bool{}
+	r := rand.New(rand.NewSource(1))
+	for _, k := range r.Perm(3000) {
+		tree.Insert(k, []byte{byte(k)})
+		present[k] = true
+	}
+	//replacing a value doesn't change the counts
+	tree.Insert(7, []byte{1, 2, 3})
+	for _, k := range r.Perm(3000)[:1700] {
+		tree.Delete(k)
+		delete(present, k)
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkRanks := func(tree *BTree) {
+		t.Helper()
+		keys := treeKeys(tree)
+		if count := tree.Count(); count != len(present) || count != len(keys) {
+			t.Fatalf("Expected %d keys; Count says %d", len(present), count)
+		}
+		for _, rank := range []int{0, 1, 99, 500, len(keys) - 1} {
+			key, value, ok := tree.GetRank(rank)
+			if !ok || decodeKey(key) != keys[rank] {
+				t.Errorf("Rank %d: Expected key %d; got %d", rank, keys[rank], decodeKey(key))
+			}
+			if v, _ := tree.Get(int(keys[rank])); !bytes.Equal(v, value) {
+				t.Errorf("Rank %d: Expected value %v; got %v", rank, v, value)
+			}
+		}
+		if _, _, ok := tree.GetRank(len(keys)); ok {
+			t.Errorf("Expected nothing at rank %d", len(keys))
+		}
+		//an OFFSET carries on from the row it skipped to
+		c := tree.NewCursor()
+		n := 0
+		for c.SeekRank(1000); c.Available(); c.Next() {
+			if c.Key() != keys[1000+n] {
+				t.Fatalf("Expected key %d after the offset; got %d", keys[1000+n], c.Key())
+			}
+			n++
+		}
+		if n != len(keys)-1000 {
+			t.Errorf("Expected %d keys after the offset; got %d", len(keys)-1000, n)
+		}
+	}
+	checkRanks(tree)
+	closeDB()
+
+	//the interior pages say the tree keeps counts
+	tree, closeDB = openTestDB(t, name)
+	defer closeDB()
+	if !tree.counted {
+		t.Fatal("Expected a fetched tree to keep counts")
+	}
+	checkRanks(tree)
+
+	//a tree that didn't keep counts gives the same answers, and the same again once it does
+	s := storage.CreateTemp()
+	defer s.Close()
+	plain := NewIn(s)
+	for k := range present {
+		plain.Insert(k, []byte{byte(k)})
+	}
+	checkRanks(plain)
+	plain.KeepCounts()
+	if err := plain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkRanks(plain)
+
+	//bulk loads write the counts as they go
+	loaded := NewIn(s)
+	loaded.KeepCounts()
+	loader, err := loaded.NewLoader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range treeKeys(tree) {
+		loader.Add(encodeKey(int(k)), []byte{byte(k)})
+	}
+	if err := loader.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	checkRanks(loaded)
+}
+
+func Test_Insert_Batch(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	tree.KeepCounts()
+
+	want := map[uint64][]byte{}
+	r := rand.New(rand.NewSource(1))
+	for batch := 0; batch < 20; batch++ {
+		var keys, values [][]byte
+		for x := 0; x < 200; x++ {
+			//some keys come up twice in a batch, the last value wins
+			k := r.Intn(3000)
+			v := []byte(fmt.Sprintf("%d.%d", batch, x))
+			keys = append(keys, encodeKey(k))
+			values = append(values, v)
+			want[uint64(k)] = v
+		}
+		if err := tree.InsertBatch(keys, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if count := tree.Count(); count != len(want) {
+		t.Fatalf("Expected %d keys; got %d", len(want), count)
+	}
+	for k, v := range want {
+		if got, _ := tree.Get(int(k)); !bytes.Equal(got, v) {
+			t.Errorf("Key %d: Expected %q; got %q", k, v, got)
+		}
+	}
+
+	//appending a sorted batch only goes down the tree once per leaf it fills
+	var keys, values [][]byte
+	for k := 5000; k < 8000; k++ {
+		keys = append(keys, encodeKey(k))
+		values = append(values, []byte{byte(k)})
+	}
+	before := tree.version
+	if err := tree.InsertBatch(keys, values); err != nil {
+		t.Fatal(err)
+	}
+	if descents := tree.version - before; descents > uint64(len(keys)/10) {
+		t.Errorf("Expected a descent per leaf; got %d for %d keys", descents, len(keys))
+	}
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if fill := averageLeafFill(tree); fill < 0.7 {
+		t.Errorf("Expected appended leaves to be packed; average fill is %.2f", fill)
+	}
+
+	if err := tree.InsertBatch(keys, values[1:]); err != ErrBatchLength {
+		t.Errorf("Expected ErrBatchLength; got %v", err)
+	}
+	if err := tree.InsertBatch([][]byte{encodeKey(1)}, [][]byte{make([]byte, pageCapacity)}); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge; got %v", err)
+	}
+}
+
+func Test_Multimap(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	m := NewMultimap(NewIn(s))
+
+	//"ab" sorts after every entry of "a" whatever their row ids
+	keys := [][]byte{[]byte("a"), []byte("ab"), []byte("b")}
+	r := rand.New(rand.NewSource(1))
+	for _, rowID := range r.Perm(600) {
+		key := keys[rowID%len(keys)]
+		if err := m.Insert(key, uint64(rowID), []byte(fmt.Sprintf("%s%d", key, rowID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !m.Delete([]byte("ab"), 4) || m.Delete([]byte("ab"), 4) {
+		t.Error("Expected to delete (ab, 4) once")
+	}
+	if m.Delete([]byte("a"), 4) {
+		t.Error("Expected no entry (a, 4)")
+	}
+	if err := m.Tree().Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, key := range keys {
+		var rowIDs []uint64
+		for c := m.Entries(key); c.Available(); c.Next() {
+			if want := fmt.Sprintf("%s%d", key, c.RowID()); string(c.Data()) != want {
+				t.Errorf("Expected %q; got %q", want, c.Data())
+			}
+			rowIDs = append(rowIDs, c.RowID())
+		}
+		want := 200
+		if k == 1 {
+			want--
+		}
+		if len(rowIDs) != want {
+			t.Errorf("Key %q: Expected %d entries; got %d", key, want, len(rowIDs))
+		}
+		for x := 1; x < len(rowIDs); x++ {
+			if rowIDs[x-1] >= rowIDs[x] {
+				t.Fatalf("Key %q: Expected row ids in order; got %d before %d", key, rowIDs[x-1], rowIDs[x])
+			}
+		}
+	}
+	if c := m.Entries([]byte("aa")); c.Available() {
+		t.Errorf("Expected no entries for %q; got row id %d", "aa", c.RowID())
+	}
+	if v, ok := m.Get([]byte("b"), 2); !ok || string(v) != "b2" {
+		t.Errorf("Expected %q; got %q", "b2", v)
+	}
+}
+
+//sqlCompare orders two values the way SQL does: NULL, numbers, text, then blobs
+func sqlCompare(a, b interface{}) int {
+	class := func(v interface{}) int {
+		switch v.(type) {
+		case nil:
+			return 0
+		case int64, float64:
+			return 1
+		case string:
+			return 2
+		}
+		return 3
+	}
+	if ca, cb := class(a), class(b); ca != cb || ca == 0 {
+		return ca - cb
+	}
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case []byte:
+		return bytes.Compare(a, b.([]byte))
+	}
+	//compare numbers exactly, big ints don't fit in a float64.
+	//Infinities go at the ends and every NaN after +Inf.
+	toRat := func(v interface{}) (int, *big.Rat) {
+		if i, ok := v.(int64); ok {
+			return 0, new(big.Rat).SetInt64(i)
+		}
+		f := v.(float64)
+		switch {
+		case math.IsNaN(f):
+			return 2, new(big.Rat)
+		case math.IsInf(f, 0):
+			return int(math.Copysign(1, f)), new(big.Rat)
+		}
+		return 0, new(big.Rat).SetFloat64(f)
+	}
+	infA, ratA := toRat(a)
+	infB, ratB := toRat(b)
+	if infA != infB {
+		return infA - infB
+	}
+	return ratA.Cmp(ratB)
+}
+
+func Test_Tuple(t *testing.T) {
+	values := []interface{}{
+		nil,
+		int64(0), int64(-1), int64(1), int64(42),
+		int64(math.MaxInt64), int64(math.MaxInt64 - 1), int64(math.MinInt64), int64(math.MinInt64 + 1),
+		int64(1<<53 + 1), int64(1 << 53), int64(-(1<<53 + 1)),
+		0.5, -0.5, 1.0, 42.0, math.Inf(1), math.Inf(-1), float64(1 << 53), float64(1 << 63), -float64(1 << 63),
+		math.NaN(), math.Copysign(math.NaN(), -1), math.Float64frombits(0x7FF0000000000001), math.Copysign(0, -1),
+		"", "a", "ab", "a\x00", "a\x00b", "b",
+		[]byte{}, []byte{0}, []byte{0, 0}, []byte{1}, []byte{0xFF},
+	}
+	r := rand.New(rand.NewSource(1))
+	var tuples [][]interface{}
+	for x := 0; x < 2000; x++ {
+		tuple := make([]interface{}, 1+r.Intn(3))
+		for c := range tuple {
+			tuple[c] = values[r.Intn(len(values))]
+		}
+		tuples = append(tuples, tuple)
+	}
+	for _, v := range values {
+		tuples = append(tuples, []interface{}{v})
+	}
+
+	compareTuples := func(a, b []interface{}) int {
+		for c := 0; c < len(a) && c < len(b); c++ {
+			if cmp := sqlCompare(a[c], b[c]); cmp != 0 {
+				return cmp
+			}
+		}
+		return len(a) - len(b)
+	}
+	encoded := make([][]byte, len(tuples))
+	for x, tuple := range tuples {
+		key, err := EncodeTuple(tuple...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded[x] = key
+		decoded, err := DecodeTuple(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compareTuples(decoded, tuple) != 0 || len(decoded) != len(tuple) {
+			t.Errorf("Expected %#v back; got %#v", tuple, decoded)
+		}
+	}
+	//sorted by their keys the tuples are in SQL order
+	order := make([]int, len(tuples))
+	for x := range order {
+		order[x] = x
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bytes.Compare(encoded[order[a]], encoded[order[b]]) < 0
+	})
+	for x := 0; x+1 < len(order); x++ {
+		a, b := order[x], order[x+1]
+		want := compareTuples(tuples[a], tuples[b])
+		got := bytes.Compare(encoded[a], encoded[b])
+		if want > 0 || (want == 0) != (got == 0) {
+			t.Errorf("Expected %#v and %#v to compare %d; the keys compare %d", tuples[a], tuples[b], want, got)
+		}
+	}
+
+	if _, err := EncodeTuple(int32(1)); !errors.Is(err, ErrTupleType) {
+		t.Errorf("Expected ErrTupleType; got %v", err)
+	}
+	if key, _ := EncodeTuple(math.Copysign(0, -1)); !bytes.Equal(key, mustEncode(t, 0.0)) {
+		t.Error("Expected -0 and 0 to be the same key")
+	}
+	if key, _ := EncodeTuple(math.Copysign(math.NaN(), -1)); !bytes.Equal(key, mustEncode(t, math.NaN())) {
+		t.Error("Expected every NaN to be the same key")
+	}
+	if key, _ := EncodeTuple(1.0); !bytes.Equal(key, mustEncode(t, int64(1))) {
+		t.Error("Expected 1 and 1.0 to be the same key")
+	}
+	decoded, _ := DecodeTuple(mustEncode(t, 1.0, 0.5, float64(1<<63), math.NaN()))
+	if _, ok := decoded[0].(int64); !ok {
+		t.Errorf("Expected 1.0 back as an int64; got %T", decoded[0])
+	}
+	if _, ok := decoded[1].(float64); !ok {
+		t.Errorf("Expected 0.5 back as a float64; got %T", decoded[1])
+	}
+	if _, ok := decoded[2].(float64); !ok {
+		t.Errorf("Expected 2^63 back as a float64; got %T", decoded[2])
+	}
+	if f, ok := decoded[3].(float64); !ok || !math.IsNaN(f) {
+		t.Errorf("Expected NaN back; got %v", decoded[3])
+	}
+	for _, bad := range [][]byte{{0x99}, {tag_number, 1, 2}, {tag_text, 'a'}, {tag_blob, 0, 7}} {
+		if _, err := DecodeTuple(bad); err != ErrBadTuple {
+			t.Errorf("%v: Expected ErrBadTuple; got %v", bad, err)
+		}
+	}
+}
+
+func mustEncode(t *testing.T, values ...interface{}) []byte {
+	key, err := EncodeTuple(values...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_Write_Dot(t *testing.T) {
+	smallPages(t)
+	s := storage.CreateTemp()
+	defer s.Close()
+	tree := NewIn(s)
+	tree.KeepCounts()
+	for k := 0; k < 300; k++ {
+		tree.Insert(k, []byte{byte(k)})
+	}
+	var b strings.Builder
+	if err := tree.WriteDot(&b, FormatIntKey); err != nil {
+		t.Fatal(err)
+	}
+	dot := b.String()
+	if !strings.HasPrefix(dot, "digraph btree {") || !strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("Expected a digraph; got %q", dot)
+	}
+
+	stats := tree.Stats()
+	root := storage.PageNumber(tree.root.Page().Offset())
+	if !strings.Contains(dot, fmt.Sprintf("\tpage%d [label=", root)) {
+		t.Errorf("Expected the root page %d to be drawn", root)
+	}
+	if edges := strings.Count(dot, " -> ") - strings.Count(dot, "style=dashed"); edges != stats.Interiors+stats.Leaves-1 {
+		t.Errorf("Expected an edge to every node but the root, %d; got %d", stats.Interiors+stats.Leaves-1, edges)
+	}
+	if siblings := strings.Count(dot, "style=dashed"); siblings != stats.Leaves-1 {
+		t.Errorf("Expected %d sibling links; got %d", stats.Leaves-1, siblings)
+	}
+
+	//every leaf key is shown, the formatter decides how
+	b.Reset()
+	tree.WriteDot(&b, func(key []byte) string {
+		return fmt.Sprintf("<%d>", decodeKey(key))
+	})
+	for k := 0; k < 300; k++ {
+		if !strings.Contains(b.String(), fmt.Sprintf("<%d>", k)) {
+			t.Fatalf("Expected key %d to be shown", k)
+		}
+	}
+
+	//without one keys are quoted, 8 bytes of text too
+	text := NewIn(s)
+	text.InsertKey([]byte("abcdefgh"), nil)
+	b.Reset()
+	text.WriteDot(&b, nil)
+	if !strings.Contains(b.String(), `\"abcdefgh\"`) {
+		t.Errorf("Expected the key to be shown as text; got %q", b.String())
+	}
+}
@@ -0,0 +1,192 @@
+package btree
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Node cache:
+A node read from disk stays in its parent's children until it's evicted,
+so how much of the tree is in memory doesn't depend on how big the tree is.
+Every node below the root is on the tree's cache list and once there are more
+than the cache size the oldest ones are dropped from their parents.
+The next time they're needed they're read from their page again.
+
+Eviction is a clock: reaching a node through its parent marks it referenced,
+a referenced node gets another trip around the list instead of being evicted.
+
+Nodes are written through to their pages so there's never anything to save.
+Dropping a node needs its parent's latch and its own and it only ever tries
+to take them. If somebody holds either the node is skipped, whoever holds them
+is using it anyway. A node is only dropped once none of its children are
+in memory, so nobody can be below it either.
+
+Stats and Verify hold a node while they go through its children so the
+cache can go over by a node's worth of children until they're done.
+
+Cursors keep nodes around without latches. A dropped node is marked so
+a cursor holding it seeks back into the tree. Only those cursors do, eviction
+doesn't touch the tree's version so it doesn't send every cursor back.
+*/
+
+//DEFAULT_CACHE_SIZE is how many nodes a tree keeps in memory unless SetCacheSize is called
+const DEFAULT_CACHE_SIZE = 1024
+
+//min_cache_size keeps a few paths from the root in memory so seeks don't evict each other
+const min_cache_size = 16
+
+type nodeCache struct {
+	mu    sync.Mutex
+	size  int
+	nodes *list.List //of noder, the clock hand is at the back
+}
+
+//cacheEntry is what a node needs to be on the cache list
+type cacheEntry struct {
+	parent     atomic.Pointer[interiorNode] //nil for the root and nodes that aren't in the tree
+	referenced atomic.Bool
+	dropped    atomic.Bool   //evicted from its parent, cursors holding it seek again
+	element    *list.Element //guarded by the cache's mutex
+}
+
+func (e *cacheEntry) entry() *cacheEntry {
+	return e
+}
+
+func newNodeCache() *nodeCache {
+	return &nodeCache{size: DEFAULT_CACHE_SIZE, nodes: list.New()}
+}
+
+//SetCacheSize sets how many nodes the tree keeps in memory.
+//The root is always kept and sizes under 16 are taken as 16.
+func (t *BTree) SetCacheSize(nodes int) {
+	if nodes < min_cache_size {
+		nodes = min_cache_size
+	}
+	t.cache.mu.Lock()
+	t.cache.size = nodes
+	t.cache.mu.Unlock()
+	t.evict()
+}
+
+//cached puts a node on the cache list as a child of parent.
+//The caller mustn't hold the parent's loading mutex.
+func (t *BTree) cached(n noder, parent *interiorNode) {
+	if t == nil {
+		return
+	}
+	e := n.entry()
+	e.parent.Store(parent)
+	e.referenced.Store(true)
+	t.cache.mu.Lock()
+	if e.element == nil {
+		e.element = t.cache.nodes.PushFront(n)
+	}
+	t.cache.mu.Unlock()
+	t.evict()
+}
+
+//uncached takes a node that is no longer anybody's child off the cache list
+func (t *BTree) uncached(n noder) {
+	if t == nil {
+		return
+	}
+	e := n.entry()
+	e.parent.Store(nil)
+	t.cache.mu.Lock()
+	if e.element != nil {
+		t.cache.nodes.Remove(e.element)
+		e.element = nil
+	}
+	t.cache.mu.Unlock()
+}
+
+//clear forgets every node, for when the whole tree is replaced
+func (c *nodeCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.nodes.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(noder).entry()
+		entry.parent.Store(nil)
+		entry.element = nil
+	}
+	c.nodes.Init()
+}
+
+//reparent records that the loaded children of i are its own, after they moved from another node
+func (i *interiorNode) reparent() {
+	for _, c := range i.children {
+		if c != nil {
+			c.entry().parent.Store(i)
+		}
+	}
+}
+
+//evict drops nodes until the cache is back to its size or nothing more can be dropped
+func (t *BTree) evict() {
+	c := t.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	//every node gets two looks, one to clear its referenced mark and one to drop it.
+	//Dropping a node can let its parent go so that starts the count again.
+	for tries := 2 * c.nodes.Len(); c.nodes.Len() > c.size && tries > 0; tries-- {
+		back := c.nodes.Back()
+		n := back.Value.(noder)
+		e := n.entry()
+		if e.referenced.Swap(false) || !t.drop(n) {
+			c.nodes.MoveToFront(back)
+			continue
+		}
+		c.nodes.Remove(back)
+		e.element = nil
+		tries = 2 * c.nodes.Len()
+	}
+}
+
+//drop removes n from its parent's children if nobody is using either of them.
+//It returns false if n has to stay.
+func (t *BTree) drop(n noder) bool {
+	e := n.entry()
+	parent := e.parent.Load()
+	if parent == nil {
+		//the root or a node that was merged away, there's nothing to drop it from
+		return true
+	}
+	if !parent.TryLock() {
+		return false
+	}
+	defer parent.Unlock()
+	if e.parent.Load() != parent {
+		//moved to another parent before we got the latch
+		return false
+	}
+	index := -1
+	for x, c := range parent.children {
+		if c == n {
+			index = x
+		}
+	}
+	if index == -1 {
+		return true
+	}
+	if !n.TryLock() {
+		return false
+	}
+	defer n.Unlock()
+	if i, ok := n.(*interiorNode); ok {
+		for _, c := range i.children {
+			if c != nil {
+				return false
+			}
+		}
+	}
+	//cursors holding n without a latch have to find their way back in
+	e.dropped.Store(true)
+	parent.loading.Lock()
+	parent.children[index] = nil
+	parent.loading.Unlock()
+	e.parent.Store(nil)
+	return true
+}
@@ -4,20 +4,18 @@ import (
 	"fmt"
 	"github.com/MattParker89/seaquell/btree"
 	"github.com/MattParker89/seaquell/storage"
+	"os"
 )
 
 func main() {
 	fmt.Println("start")
-	var tree *btree.BTree
-	s, err := storage.Open("test.db")
+	s, err := storage.Open("test.db", storage.MODE_CREATE)
 	if err != nil {
 		fmt.Println("error opening db ", err)
-		s, _ = storage.Create("test.db")
-		tree = btree.New()
-	} else {
-		tree = btree.Fetch(0)
+		return
 	}
 	defer s.Close()
+	tree := btree.Fetch(0)
 
 	var instruction string
 	var key int
@@ -29,11 +27,39 @@ func main() {
 
 		switch instruction {
 		case "add":
-			tree.Insert(key, []byte{byte(value)})
+			if err := tree.Insert(key, []byte{byte(value)}); err != nil {
+				fmt.Println("error: ", err)
+			}
 		case "get":
-			fmt.Println("Value: ", tree.Get(key))
+			if value, found := tree.Get(key); found {
+				fmt.Println("Value: ", value)
+			} else {
+				fmt.Println("not found")
+			}
+		case "stats":
+			stats := tree.Stats()
+			fmt.Printf("depth %d, %d interior and %d leaf nodes, %d keys, %.0f%% full, %d bytes of keys and values\n",
+				stats.Depth, stats.Interiors, stats.Leaves, stats.Keys, stats.Fill*100, stats.PayloadBytes)
+		case "dot":
+			if err := writeDot(tree, "tree.dot"); err != nil {
+				fmt.Println("error: ", err)
+			} else {
+				fmt.Println("wrote tree.dot, render it with dot -Tsvg tree.dot > tree.svg")
+			}
 		}
 		tree.Print()
 		fmt.Println(" ")
 	}
 }
+
+func writeDot(tree *btree.BTree, name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := tree.WriteDot(f, btree.FormatIntKey); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,143 @@
+package btree
+
+import (
+	"github.com/MattParker89/seaquell/storage"
+	"sync/atomic"
+)
+
+/*
+Counts:
+A tree can keep how many rows are under each child of its interior nodes.
+Then the rows in the tree are the root's counts added up, and the row
+with a given rank is found by going down the tree skipping whole children,
+both without reading more than a path from the root.
+
+Every insert or delete changes the counts all the way up, so in a tree that
+keeps counts writers hold their whole path, no node is safe.
+
+Interior pages say if they have counts so a fetched tree knows it keeps them,
+unless its root is still a leaf. Like the comparator that has to be set again.
+*/
+
+//KeepCounts makes the tree keep counts from now on. A tree that didn't is counted
+//first, which reads and rewrites all of its interior nodes.
+//Like the fill factor it has to be set before the tree is shared between goroutines.
+func (t *BTree) KeepCounts() {
+	if t.counted {
+		return
+	}
+	t.rootLatch.Lock()
+	defer t.rootLatch.Unlock()
+	t.counted = true
+	atomic.AddUint64(&t.version, 1)
+	if root, ok := t.root.(*interiorNode); ok {
+		if k, right := root.countAll(); right != nil {
+			t.growRoot(k, right)
+		}
+	}
+	//everything was held on the way down so nothing could be evicted
+	t.evict()
+}
+
+//countAll counts the rows under every child and writes the node, children first.
+//The counts make the node bigger so like an insert it can split.
+func (i *interiorNode) countAll() ([]byte, noder) {
+	i.Lock()
+	defer i.Unlock()
+	i.load()
+	for x := 0; x < len(i.pages); x++ {
+		if c, ok := i.child(x).(*interiorNode); ok {
+			if k, right := c.countAll(); right != nil {
+				i.insertChild(x, k, right)
+				i.recount(x)
+				x++
+			}
+		}
+		i.recount(x)
+	}
+	if !i.tree.interiorFits(i.keys) {
+		return i.split(false)
+	}
+	i.write()
+	return nil, nil
+}
+
+//Count returns how many keys are in the tree.
+//Trees that don't keep counts are counted leaf by leaf.
+func (t *BTree) Count() int {
+	if !t.counted {
+		return t.Stats().Keys
+	}
+	root := t.latchRoot()
+	defer root.RUnlock()
+	root.load()
+	return int(root.rows())
+}
+
+//GetRank returns the key and value with rank keys before it, counting from 0.
+//ok is false if the tree has no more than rank keys.
+func (t *BTree) GetRank(rank int) (key []byte, value []byte, ok bool) {
+	c := t.NewCursor()
+	c.SeekRank(rank)
+	if !c.Available() {
+		return nil, nil, false
+	}
+	return c.KeyBytes(), c.Data(), true
+}
+
+//recount sets the count of the child at index and says if it changed.
+//It does nothing unless the tree keeps counts.
+func (i *interiorNode) recount(index int) bool {
+	if !i.tree.counted {
+		return false
+	}
+	rows := i.child(index).rows()
+	if i.counts[index] == rows {
+		return false
+	}
+	i.counts[index] = rows
+	return true
+}
+
+func (i *interiorNode) rows() uint64 {
+	var rows uint64
+	for _, c := range i.counts {
+		rows += c
+	}
+	return rows
+}
+
+func (l *leafNode) rows() uint64 {
+	l.load()
+	return uint64(len(l.keys))
+}
+
+//childAtRank returns the child the row with the given rank is under
+//and the row's rank within that child. A rank past the end goes to the last child.
+func (i *interiorNode) childAtRank(rank uint64) (int, uint64) {
+	last := len(i.counts) - 1
+	for x, c := range i.counts[:last] {
+		if rank < c {
+			return x, rank
+		}
+		rank -= c
+	}
+	return last, rank
+}
+
+//storedCounts is what an interior page holds for the counts, nil if the tree doesn't keep them
+func (t *BTree) storedCounts(counts []uint64) []uint64 {
+	if t == nil || !t.counted {
+		return nil
+	}
+	return counts
+}
+
+//storesCounts says if the page is an interior page with counts on it
+func storesCounts(p storage.Pager) bool {
+	if p.Type() != storage.INTERIOR_NODE {
+		return false
+	}
+	_, _, counts := p.FetchInterior()
+	return counts != nil
+}
@@ -0,0 +1,295 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/MattParker89/seaquell/storage"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Copy-on-write:
+A copy-on-write tree never changes a page that belongs to a committed version.
+The first time a node is written after a commit it moves to a new page,
+and so does its parent, because the pointer to it changed, all the way up
+to the root. Pages that were written since the last commit are fresh and
+get written in place.
+
+The tree is known by its anchor page, a leaf whose keys are version numbers
+and whose values are the offsets of their root pages. Commit adds the current
+root to it. Rollback frees the fresh pages and goes back to the last committed
+root. Snapshot gives a read-only tree of a version, its pages never change
+so readers don't wait on writers.
+
+Old pages are kept for as long as a version that can reach them is kept.
+Forget drops old versions and frees the pages none of the remaining ones use.
+
+Leaves don't have right pointers in a copy-on-write tree, moving a leaf
+would mean moving its left sibling too. Cursors follow their path instead.
+*/
+
+var ErrNotCopyOnWrite = errors.New("btree: tree isn't copy-on-write")
+var ErrNoVersion = errors.New("btree: version isn't kept")
+
+//The anchor is a single page, old versions have to be forgotten before it fills up
+var ErrTooManyVersions = errors.New("btree: too many versions kept")
+
+type copyOnWrite struct {
+	mu       sync.Mutex //guards fresh, versions and roots
+	txn      sync.RWMutex
+	anchor   storage.Pager
+	fresh    map[uint64]storage.Pager //pages written since the last commit
+	versions []uint64                 //committed versions, oldest first
+	roots    []uint64                 //root page offset of each version
+}
+
+//Snapshot is a committed version of a copy-on-write tree
+type Snapshot struct {
+	tree    *BTree
+	version uint64
+}
+
+//FetchCOW opens the copy-on-write tree anchored at page number.
+//An empty page becomes the anchor of a new tree.
+func FetchCOW(number int) *BTree {
+	return newCOW(storage.GetPageNumber(number))
+}
+
+//NewCOWIn creates a copy-on-write tree whose pages live in s
+func NewCOWIn(s storage.Storer) *BTree {
+	return newCOW(storage.NewPageIn(s))
+}
+
+func newCOW(anchor storage.Pager) *BTree {
+	t := newTree()
+	c := &copyOnWrite{
+		anchor: anchor,
+		fresh:  map[uint64]storage.Pager{},
+	}
+	t.cow = c
+
+	keys, values, _ := anchor.FetchLeaf()
+	for i, k := range keys {
+		c.versions = append(c.versions, decodeKey(k))
+		c.roots = append(c.roots, binary.LittleEndian.Uint64(values[i]))
+	}
+	if len(c.versions) == 0 {
+		root := anchor.Create()
+		root.WriteLeaf(nil, nil, nil)
+		c.versions = []uint64{1}
+		c.roots = []uint64{root.Offset()}
+		c.writeAnchor()
+	}
+	t.root = newNode(t, anchor.At(c.roots[len(c.roots)-1]))
+	t.root.load()
+	t.counted = storesCounts(t.root.Page())
+	return t
+}
+
+func (c *copyOnWrite) writeAnchor() {
+	keys := make([][]byte, len(c.versions))
+	values := make([][]byte, len(c.versions))
+	for i, v := range c.versions {
+		keys[i] = encodeKey(int(v))
+		values[i] = make([]byte, 8)
+		binary.LittleEndian.PutUint64(values[i], c.roots[i])
+	}
+	c.anchor.WriteLeaf(keys, values, nil)
+}
+
+func (c *copyOnWrite) isFresh(p storage.Pager) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.fresh[p.Offset()]
+	return ok
+}
+
+//newPage allocates a page in the same storage as near
+func (t *BTree) newPage(near storage.Pager) storage.Pager {
+	p := near.Create()
+	if t != nil && t.cow != nil {
+		t.cow.mu.Lock()
+		t.cow.fresh[p.Offset()] = p
+		t.cow.mu.Unlock()
+	}
+	return p
+}
+
+//free gives a page back to the storage unless a committed version still uses it
+func (t *BTree) free(p storage.Pager) {
+	if t != nil && t.cow != nil {
+		t.cow.mu.Lock()
+		_, ok := t.cow.fresh[p.Offset()]
+		delete(t.cow.fresh, p.Offset())
+		t.cow.mu.Unlock()
+		if !ok {
+			return
+		}
+	}
+	p.Free()
+}
+
+//shadow moves the node to a fresh page before it's written, if it has to
+func (t *BTree) shadow(n noder) {
+	if t.moves(n) {
+		n.setPage(t.newPage(n.Page()))
+	}
+}
+
+//moves says if writing the node will put it on a new page
+func (t *BTree) moves(n noder) bool {
+	return t != nil && t.cow != nil && !t.cow.isFresh(n.Page())
+}
+
+//siblingPointers says if leaves keep a pointer to their right sibling
+func (t *BTree) siblingPointers() bool {
+	return t == nil || t.cow == nil
+}
+
+/*
+Commit makes what has been written so far a new version and returns its number.
+If nothing changed the last version is returned and no new one is made.
+*/
+func (t *BTree) Commit() (uint64, error) {
+	c := t.cow
+	if c == nil {
+		return 0, ErrNotCopyOnWrite
+	}
+	c.txn.Lock()
+	defer c.txn.Unlock()
+	t.rootLatch.RLock()
+	root := t.root.Page().Offset()
+	t.rootLatch.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	last := len(c.versions) - 1
+	if root == c.roots[last] {
+		return c.versions[last], nil
+	}
+	if (len(c.versions)+1)*storage.LeafCellSize(make([]byte, 8), make([]byte, 8)) > storage.PAGE_CAPACITY {
+		return 0, ErrTooManyVersions
+	}
+	c.versions = append(c.versions, c.versions[last]+1)
+	c.roots = append(c.roots, root)
+	//the fresh pages belong to the new version now
+	c.fresh = map[uint64]storage.Pager{}
+	c.writeAnchor()
+	return c.versions[last+1], nil
+}
+
+//Rollback throws away everything written since the last commit
+func (t *BTree) Rollback() error {
+	c := t.cow
+	if c == nil {
+		return ErrNotCopyOnWrite
+	}
+	c.txn.Lock()
+	defer c.txn.Unlock()
+	t.rootLatch.Lock()
+	defer t.rootLatch.Unlock()
+
+	c.mu.Lock()
+	for _, p := range c.fresh {
+		p.Free()
+	}
+	c.fresh = map[uint64]storage.Pager{}
+	root := c.roots[len(c.roots)-1]
+	c.mu.Unlock()
+
+	//cursors can't trust any node they know of
+	atomic.AddUint64(&t.version, 1)
+	t.cache.clear()
+	t.root = newNode(t, c.anchor.At(root))
+	t.root.load()
+	return nil
+}
+
+//Versions returns the committed versions that are kept, oldest first
+func (t *BTree) Versions() []uint64 {
+	if t.cow == nil {
+		return nil
+	}
+	t.cow.mu.Lock()
+	defer t.cow.mu.Unlock()
+	return append([]uint64{}, t.cow.versions...)
+}
+
+//Snapshot returns a read-only tree of a committed version.
+//It stays valid until the version is forgotten.
+func (t *BTree) Snapshot(version uint64) (*Snapshot, error) {
+	c := t.cow
+	if c == nil {
+		return nil, ErrNotCopyOnWrite
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, v := range c.versions {
+		if v == version {
+			s := newTree()
+			s.comparator = t.comparator
+			s.counted = t.counted
+			s.root = newNode(s, c.anchor.At(c.roots[i]))
+			return &Snapshot{tree: s, version: v}, nil
+		}
+	}
+	return nil, ErrNoVersion
+}
+
+/*
+Forget drops the versions before version and frees the pages only they use.
+The last version is always kept. Snapshots of forgotten versions mustn't be used afterwards.
+*/
+func (t *BTree) Forget(version uint64) error {
+	c := t.cow
+	if c == nil {
+		return ErrNotCopyOnWrite
+	}
+	c.txn.Lock()
+	defer c.txn.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keep := len(c.versions) - 1
+	for i, v := range c.versions {
+		if v >= version {
+			keep = i
+			break
+		}
+	}
+	if keep == 0 {
+		return nil
+	}
+
+	//a page is shared with everything under it so walks stop at pages already seen
+	seen := map[uint64]bool{}
+	for _, r := range c.roots[keep:] {
+		walkPages(c.anchor, r, seen, nil)
+	}
+	for _, r := range c.roots[:keep] {
+		walkPages(c.anchor, r, seen, func(p storage.Pager) {
+			p.Free()
+		})
+	}
+	c.versions = c.versions[keep:]
+	c.roots = c.roots[keep:]
+	c.writeAnchor()
+	return nil
+}
+
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+func (s *Snapshot) Get(key int) ([]byte, bool) {
+	return s.tree.Get(key)
+}
+
+func (s *Snapshot) GetKey(key []byte) ([]byte, bool) {
+	return s.tree.GetKey(key)
+}
+
+func (s *Snapshot) NewCursor() *Cursor {
+	return s.tree.NewCursor()
+}
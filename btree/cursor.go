@@ -0,0 +1,367 @@
+package btree
+
+import (
+	"sync/atomic"
+)
+
+/*
+A cursor remembers the path it took from the root to its leaf.
+Moving past either end of a leaf walks back up the path to the nearest
+interior node with a child on that side and back down to the next leaf.
+This is what lets the cursor go backwards, leaves only know their right sibling.
+
+A tree can have any number of cursors, each with its own position.
+Every change to the tree bumps its version. A cursor that sees a version
+it doesn't know seeks back to the key it was on before going anywhere,
+so inserts and deletes through the tree or another cursor never leave it
+pointing at the wrong row. So does a cursor whose leaf or path was evicted
+from the node cache.
+*/
+
+type Cursor struct {
+	tree    *BTree
+	path    []position //interior nodes from the root down to the leaf's parent
+	node    *leafNode  //nil when the cursor is off the end of the tree
+	index   int
+	current []byte //the key the cursor is on
+	version uint64 //the tree's version when the cursor was positioned
+	lo, hi  []byte //with bounded set the cursor only sees keys in [lo, hi)
+	bounded bool
+}
+
+//NewCursor returns a cursor that isn't positioned yet.
+//Call First, Last, Seek or Range before using it.
+func (t *BTree) NewCursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+//position is the child an interior node on the cursor's path leads to
+type position struct {
+	node  *interiorNode
+	index int
+}
+
+//First puts the cursor on the smallest key
+func (c *Cursor) First() {
+	c.bounded = false
+	c.reset()
+	c.descend(c.root(), false)
+	c.settle()
+}
+
+//Last puts the cursor on the largest key
+func (c *Cursor) Last() {
+	c.bounded = false
+	c.reset()
+	c.descend(c.root(), true)
+	c.settle()
+}
+
+//Seek puts the cursor on the first key >= key
+func (c *Cursor) Seek(key int) {
+	c.SeekKey(encodeKey(key))
+}
+
+func (c *Cursor) SeekKey(key []byte) {
+	c.bounded = false
+	c.seek(key)
+	c.settle()
+}
+
+//SeekRank puts the cursor on the key with rank keys before it, counting from 0,
+//for OFFSET. It isn't available if the tree has no more than rank keys.
+//Trees that keep counts go straight there, others are walked a leaf at a time.
+func (c *Cursor) SeekRank(rank int) {
+	c.bounded = false
+	c.reset()
+	if rank < 0 {
+		return
+	}
+	c.seekRank(uint64(rank))
+	c.settle()
+}
+
+func (c *Cursor) seekRank(rank uint64) {
+	c.reset()
+	n := c.root()
+	left := rank //rows still to skip
+	for {
+		n.load()
+		i, ok := n.(*interiorNode)
+		if !ok {
+			break
+		}
+		index := 0
+		if c.tree.counted {
+			index, left = i.childAtRank(left)
+		}
+		c.path = append(c.path, position{i, index})
+		n = i.child(index)
+		n.RLock()
+		i.RUnlock()
+	}
+	c.node = n.(*leafNode)
+	for c.node != nil && left >= uint64(len(c.node.keys)) {
+		left -= uint64(len(c.node.keys))
+		if !c.nextLeaf() {
+			//the tree changed under the walk
+			c.seekRank(rank)
+			return
+		}
+	}
+	c.index = int(left)
+}
+
+//Range puts the cursor on the first key >= lo.
+//The cursor is only available on keys in [lo, hi), whichever way it moves.
+func (c *Cursor) Range(lo, hi int) {
+	c.RangeKeys(encodeKey(lo), encodeKey(hi))
+}
+
+func (c *Cursor) RangeKeys(lo, hi []byte) {
+	c.lo, c.hi = lo, hi
+	c.bounded = true
+	c.seek(c.lo)
+	c.settle()
+}
+
+func (c *Cursor) Available() bool {
+	if c.node == nil {
+		return false
+	}
+	return !c.bounded || (c.tree.compare(c.current, c.lo) >= 0 && c.tree.compare(c.current, c.hi) < 0)
+}
+
+func (c *Cursor) Next() {
+	if c.node == nil {
+		return
+	}
+	c.node.RLock()
+	if c.stale() && !c.reseek() {
+		//the key we were on is gone, we're already on the one after it
+		c.settle()
+		return
+	}
+	c.index++
+	if c.index >= len(c.node.keys) && !c.nextLeaf() {
+		c.seekPast(c.current)
+	}
+	c.settle()
+}
+
+func (c *Cursor) Prev() {
+	if c.node == nil {
+		return
+	}
+	c.node.RLock()
+	if c.stale() {
+		c.reseek()
+	}
+	if c.node == nil {
+		//the key we were on was the last one and it's gone
+		c.reset()
+		c.descend(c.root(), true)
+		c.settle()
+		return
+	}
+	c.index--
+	if c.index < 0 && !c.prevLeaf() {
+		c.seekBefore(c.current)
+	}
+	c.settle()
+}
+
+//Key returns the key at the cursor of a tree with int keys
+func (c *Cursor) Key() uint64 {
+	if c.node == nil {
+		return 0
+	}
+	return decodeKey(c.current)
+}
+
+func (c *Cursor) KeyBytes() []byte {
+	if c.node == nil {
+		return nil
+	}
+	return c.current
+}
+
+//Data returns the value at the cursor or nil if it has been deleted since
+func (c *Cursor) Data() []byte {
+	if c.node == nil {
+		return nil
+	}
+	c.node.RLock()
+	defer c.unlatch()
+	if c.stale() && !c.reseek() {
+		return nil
+	}
+	return c.node.values[c.index]
+}
+
+func (c *Cursor) reset() {
+	c.path = c.path[:0]
+	c.node = nil
+	c.index = 0
+}
+
+//root read latches the root to start a new descent.
+//The version is read first, anything that changes after it makes the cursor stale.
+func (c *Cursor) root() noder {
+	c.version = atomic.LoadUint64(&c.tree.version)
+	return c.tree.latchRoot()
+}
+
+//settle records the key the cursor ended up on and lets go of its leaf
+func (c *Cursor) settle() {
+	if c.node != nil {
+		c.current = c.node.keys[c.index]
+	}
+	c.unlatch()
+}
+
+func (c *Cursor) unlatch() {
+	if c.node != nil {
+		c.node.RUnlock()
+	}
+}
+
+//stale says if the tree changed since the cursor was positioned or its leaf was evicted
+func (c *Cursor) stale() bool {
+	return c.version != atomic.LoadUint64(&c.tree.version) || c.node != nil && c.node.dropped.Load()
+}
+
+//reseek finds the key the cursor was on again after the tree changed.
+//It returns false if the key is gone, the cursor is then on the key after it.
+//Like every move it starts and ends with the cursor's leaf read latched.
+func (c *Cursor) reseek() bool {
+	c.unlatch()
+	key := c.current
+	c.seek(key)
+	return c.node != nil && c.tree.compare(c.node.keys[c.index], key) == 0
+}
+
+//descend walks from n down to a leaf, always taking the first child
+//or, if last is set, the last one. n has to be read latched.
+func (c *Cursor) descend(n noder, last bool) {
+	for {
+		n.load()
+		switch node := n.(type) {
+		case *interiorNode:
+			index := 0
+			if last {
+				index = len(node.pages) - 1
+			}
+			c.path = append(c.path, position{node, index})
+			n = node.child(index)
+			n.RLock()
+			node.RUnlock()
+		case *leafNode:
+			c.node = node
+			c.index = 0
+			if last {
+				c.index = len(node.keys) - 1
+			}
+			//only the root can be an empty leaf
+			if len(node.keys) == 0 {
+				node.RUnlock()
+				c.node = nil
+			}
+			return
+		}
+	}
+}
+
+//seek puts the cursor on the first key >= key
+func (c *Cursor) seek(key []byte) {
+	c.reset()
+	n := c.root()
+	for {
+		n.load()
+		i, ok := n.(*interiorNode)
+		if !ok {
+			break
+		}
+		index := i.findIndexOfKey(key)
+		c.path = append(c.path, position{i, index})
+		n = i.child(index)
+		n.RLock()
+		i.RUnlock()
+	}
+	l := n.(*leafNode)
+	c.node = l
+	c.index, _ = l.search(key)
+	//if everything in this leaf is smaller the key we want starts the next one
+	if c.index >= len(l.keys) && !c.nextLeaf() {
+		c.seek(key)
+	}
+}
+
+/*
+nextLeaf and prevLeaf go back up the path with nothing latched and latch
+the interior node they stop at. If the tree changed the path can't be
+trusted, they return false with the cursor off the tree and the caller
+seeks from the root instead.
+*/
+
+func (c *Cursor) nextLeaf() bool {
+	return c.siblingLeaf(false)
+}
+
+func (c *Cursor) prevLeaf() bool {
+	return c.siblingLeaf(true)
+}
+
+func (c *Cursor) siblingLeaf(left bool) bool {
+	c.unlatch()
+	c.node = nil
+	for len(c.path) > 0 {
+		p := &c.path[len(c.path)-1]
+		p.node.RLock()
+		if c.stale() || p.node.dropped.Load() {
+			p.node.RUnlock()
+			return false
+		}
+		next := p.index + 1
+		if left {
+			next = p.index - 1
+		}
+		if next >= 0 && next < len(p.node.pages) {
+			p.index = next
+			child := p.node.child(p.index)
+			child.RLock()
+			p.node.RUnlock()
+			c.descend(child, left)
+			return true
+		}
+		p.node.RUnlock()
+		c.path = c.path[:len(c.path)-1]
+	}
+	return true
+}
+
+//seekPast puts the cursor on the first key > key
+func (c *Cursor) seekPast(key []byte) {
+	c.seek(key)
+	if c.node != nil && c.tree.compare(c.node.keys[c.index], key) == 0 {
+		c.index++
+		if c.index >= len(c.node.keys) && !c.nextLeaf() {
+			c.seekPast(key)
+		}
+	}
+}
+
+//seekBefore puts the cursor on the last key < key
+func (c *Cursor) seekBefore(key []byte) {
+	c.seek(key)
+	if c.node == nil {
+		//nothing is >= key so the last key in the tree is the one
+		c.reset()
+		c.descend(c.root(), true)
+		return
+	}
+	c.index--
+	if c.index < 0 && !c.prevLeaf() {
+		c.seekBefore(key)
+	}
+}
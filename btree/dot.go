@@ -0,0 +1,119 @@
+package btree
+
+import (
+	"fmt"
+	"github.com/MattParker89/seaquell/storage"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+WriteDot draws the tree as a Graphviz graph, render it with
+
+	dot -Tsvg tree.dot > tree.svg
+
+Every page is a box with its page number and keys, the leaves are all
+on one row. Edges go from interior nodes to their children, labelled with
+the counts if the tree keeps them, and dashed edges follow the leaves'
+right pointers.
+
+The tree doesn't know what its keys are so key turns them into text,
+FormatIntKey for trees with int keys. Nil shows them as quoted strings.
+
+Writers wait for it but it can run alongside readers.
+*/
+func (t *BTree) WriteDot(w io.Writer, key func([]byte) string) error {
+	if key == nil {
+		key = func(k []byte) string {
+			return strconv.Quote(string(k))
+		}
+	}
+	d := &dotWriter{w: w, key: key}
+	d.printf("digraph btree {\n")
+	d.printf("\tnode [shape=box fontname=monospace];\n")
+	t.rootLatch.RLock()
+	d.node(t.root)
+	t.rootLatch.RUnlock()
+	//the children of the node being drawn couldn't be evicted while it was
+	t.evict()
+
+	d.printf("\t{ rank=same;")
+	for _, leaf := range d.leaves {
+		d.printf(" page%d;", leaf)
+	}
+	d.printf(" }\n")
+	d.printf("}\n")
+	return d.err
+}
+
+//FormatIntKey shows a key of a tree with int keys as the int, for WriteDot
+func FormatIntKey(key []byte) string {
+	if len(key) != 8 {
+		return strconv.Quote(string(key))
+	}
+	return strconv.FormatUint(decodeKey(key), 10)
+}
+
+//dot_keys_per_line keeps big leaves from being drawn as one very wide box
+const dot_keys_per_line = 8
+
+type dotWriter struct {
+	w      io.Writer
+	key    func([]byte) string
+	err    error //the first write that failed, nothing is written after it
+	leaves []int //page numbers of the leaves in order
+}
+
+func (d *dotWriter) printf(format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, format, args...)
+}
+
+//node draws n and everything under it
+func (d *dotWriter) node(n noder) {
+	n.RLock()
+	defer n.RUnlock()
+	n.load()
+	page := storage.PageNumber(n.Page().Offset())
+
+	switch n := n.(type) {
+	case *leafNode:
+		label := fmt.Sprintf("page %d\nempty", page)
+		if len(n.keys) > 0 {
+			label = fmt.Sprintf("page %d, %d keys", page, len(n.keys))
+			for x, k := range n.keys {
+				if x%dot_keys_per_line == 0 {
+					label += "\n"
+				} else {
+					label += " "
+				}
+				label += d.key(k)
+			}
+		}
+		d.printf("\tpage%d [label=%s];\n", page, strconv.Quote(label))
+		if n.right != nil && n.tree.siblingPointers() {
+			d.printf("\tpage%d -> page%d [style=dashed constraint=false];\n", page, storage.PageNumber(n.right.Offset()))
+		}
+		d.leaves = append(d.leaves, page)
+
+	case *interiorNode:
+		keys := make([]string, len(n.keys))
+		for x, k := range n.keys {
+			keys[x] = d.key(k)
+		}
+		label := fmt.Sprintf("page %d\n%s", page, strings.Join(keys, " | "))
+		d.printf("\tpage%d [label=%s];\n", page, strconv.Quote(label))
+		for x := range n.children {
+			child := n.child(x)
+			if n.tree.counted {
+				d.printf("\tpage%d -> page%d [label=%d];\n", page, storage.PageNumber(child.Page().Offset()), n.counts[x])
+			} else {
+				d.printf("\tpage%d -> page%d;\n", page, storage.PageNumber(child.Page().Offset()))
+			}
+			d.node(child)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package btree
+
+import (
+	"github.com/MattParker89/seaquell/storage"
+	"sync/atomic"
+)
+
+//DropTree frees every page of the tree whose root is page number, the root page too.
+//It reads the pages, not nodes, so the tree doesn't have to be opened first.
+//A copy-on-write tree's anchor isn't a root, open those with FetchCOW and call Drop.
+func DropTree(number int) {
+	root := storage.GetPageNumber(number)
+	walkPages(root, root.Offset(), map[uint64]bool{}, func(p storage.Pager) {
+		p.Free()
+	})
+}
+
+//Drop frees every page of the tree, for a copy-on-write tree every version's pages
+//and its anchor. The tree mustn't be used afterwards, nor snapshots of it.
+//Writers that are still going finish first, Drop latches its way down like they do.
+func (t *BTree) Drop() {
+	if c := t.cow; c != nil {
+		c.txn.Lock()
+		defer c.txn.Unlock()
+	}
+	t.rootLatch.Lock()
+	defer t.rootLatch.Unlock()
+
+	free := func(p storage.Pager) {
+		p.Free()
+	}
+	seen := map[uint64]bool{}
+	t.dropNodes(t.root, seen)
+	//old versions are only read by snapshots, their pages are walked without latches
+	if c := t.cow; c != nil {
+		c.mu.Lock()
+		for _, r := range c.roots {
+			walkPages(c.anchor, r, seen, free)
+		}
+		c.fresh = map[uint64]storage.Pager{}
+		c.mu.Unlock()
+		c.anchor.Free()
+	}
+	atomic.AddUint64(&t.version, 1)
+	t.cache.clear()
+}
+
+//dropNodes frees n and everything under it, children first.
+//A writer that let go of the root latch at a safe node is still writing below it,
+//so every node is write latched before anything under it is freed.
+func (t *BTree) dropNodes(n noder, seen map[uint64]bool) {
+	n.Lock()
+	defer n.Unlock()
+	n.load()
+	if i, ok := n.(*interiorNode); ok {
+		for x := range i.pages {
+			t.dropNodes(i.child(x), seen)
+		}
+	}
+	seen[n.Page().Offset()] = true
+	n.Page().Free()
+}
+
+//walkPages calls visit with every page under offset that isn't in seen, children first.
+//near is any page in the same storage.
+func walkPages(near storage.Pager, offset uint64, seen map[uint64]bool, visit func(storage.Pager)) {
+	if seen[offset] {
+		return
+	}
+	seen[offset] = true
+	p := near.At(offset)
+	if p.Type() == storage.INTERIOR_NODE {
+		_, children, _ := p.FetchInterior()
+		for _, child := range children {
+			walkPages(near, child.Offset(), seen, visit)
+		}
+	}
+	if visit != nil {
+		visit(p)
+	}
+}
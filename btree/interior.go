@@ -3,146 +3,253 @@ package btree
 import (
 	"fmt"
 	"github.com/MattParker89/seaquell/storage"
+	"sync"
 )
 
 type interiorNode struct {
-	keys     []uint64
-	children []noder
+	sync.RWMutex //latch
+	cacheEntry
+	keys     [][]byte
+	children []noder         //nil until the child is read from disk
+	pages    []storage.Pager //one per child, always populated once loaded
+	counts   []uint64        //rows under each child, all 0 unless the tree keeps counts
 	page     storage.Pager
+	loaded   bool
+	loading  sync.Mutex //guards loaded and filling in children
+	tree     *BTree
 }
 
-func (i *interiorNode) insert(key uint64, value []byte) *interiorNode {
-	keyLength := len(i.keys)
-	var index int = keyLength
-	for x := 0; x < keyLength; x++ {
-		if key <= i.keys[x] {
-			index = x
+func (i *interiorNode) insert(key []byte, value []byte, appending bool) ([]byte, noder) {
+	i.load()
+	index := i.findIndexOfKey(key)
+	k, right := i.child(index).insert(key, value, appending)
+	if right == nil {
+		if i.recount(index) || i.childMoved(index) {
+			i.write()
 		}
+		return nil, nil
 	}
-	i.Fetch(key)
-	child := i.children[index]
-	newNode := child.insert(key, value)
-	if newNode != nil {
-		newNode.page.Free()
+	i.insertChild(index, k, right)
+	i.recount(index)
+	i.recount(index + 1)
+	if !i.tree.interiorFits(i.keys) {
+		return i.split(appending)
+	}
+	i.write()
+	return nil, nil
+}
 
-		keys := newNode.Keys()
-		k := keys[0]
+//insertChild adds key and puts child to the right of the child at index
+func (i *interiorNode) insertChild(index int, key []byte, child noder) {
+	i.keys = append(i.keys, nil)
+	copy(i.keys[index+1:], i.keys[index:])
+	i.keys[index] = key
 
-		oldKeys := i.keys
-		i.keys = make([]uint64, len(oldKeys)+1)
-		copy(i.keys[:index], oldKeys[:index])
-		i.keys[index] = k
-		copy(i.keys[index+1:], oldKeys[index:])
+	i.children = append(i.children, nil)
+	copy(i.children[index+2:], i.children[index+1:])
+	i.children[index+1] = child
 
-		oldChildren := i.children
-		oldChildren = append(oldChildren[:index], oldChildren[index+1:]...)
-		i.children = make([]noder, len(oldChildren)+len(newNode.children))
-		copy(i.children[:index], oldChildren[:index])
-		copy(i.children[index+len(newNode.children):], oldChildren[index:])
-		copy(i.children[index:], newNode.children)
+	i.pages = append(i.pages, nil)
+	copy(i.pages[index+2:], i.pages[index+1:])
+	i.pages[index+1] = child.Page()
 
-		newNode = nil
-	}
-	if len(i.keys) >= NODE_ORDER {
-		return i.split()
-	}
-	i.write()
-	return nil
+	i.counts = append(i.counts, 0)
+	copy(i.counts[index+2:], i.counts[index+1:])
+	i.counts[index+1] = 0
+	i.tree.cached(child, i)
 }
 
-func (i *interiorNode) split() *interiorNode {
-	n := int(len(i.keys) / 2)
+//removeChild drops the key at index and the child to the right of it
+func (i *interiorNode) removeChild(index int) {
+	i.keys = append(i.keys[:index], i.keys[index+1:]...)
+	i.children = append(i.children[:index+1], i.children[index+2:]...)
+	i.pages = append(i.pages[:index+1], i.pages[index+2:]...)
+	i.counts = append(i.counts[:index+1], i.counts[index+2:]...)
+}
+
+//split keeps the lower half of the node on its page.
+//It returns the key to promote and the new right node.
+func (i *interiorNode) split(appending bool) ([]byte, noder) {
+	n := i.splitIndex(i.keys, false, appending)
 	parentKey := i.keys[n]
-	newKeys := i.keys[n+1:]
-	newChildren := i.children[n+1:]
+
+	right := &interiorNode{
+		keys:     append([][]byte{}, i.keys[n+1:]...),
+		children: append([]noder{}, i.children[n+1:]...),
+		pages:    append([]storage.Pager{}, i.pages[n+1:]...),
+		counts:   append([]uint64{}, i.counts[n+1:]...),
+		page:     i.tree.newPage(i.page),
+		loaded:   true,
+		tree:     i.tree,
+	}
 	i.keys = i.keys[:n]
 	i.children = i.children[:n+1]
+	i.pages = i.pages[:n+1]
+	i.counts = i.counts[:n+1]
 
-	right := &interiorNode{
-		keys:     newKeys,
-		children: newChildren,
-		page:     storage.NewPage(),
+	right.write()
+	i.write()
+	right.reparent()
+	return parentKey, right
+}
+
+//splitIndex picks the key that moves up when keys are cut in two.
+//Unless even is set the tree's fill factor decides how many stay on the left.
+//Both sides keep at least one key.
+func (i *interiorNode) splitIndex(keys [][]byte, even bool, appending bool) int {
+	sizes, room := i.tree.interiorCellSizes(keys)
+	target := halfOf(sizes)
+	if !even {
+		target = i.tree.splitTarget(sizes, appending)
 	}
+	n := splitIndex(sizes, target, room)
+	if n >= len(keys)-1 {
+		n = len(keys) - 2
+	}
+	return n
+}
 
-	left := &interiorNode{
-		keys:     i.keys,
-		children: i.children,
-		page:     storage.NewPage(),
+func (i *interiorNode) delete(key []byte) bool {
+	i.load()
+	index := i.findIndexOfKey(key)
+	child := i.child(index)
+	if !child.delete(key) {
+		return false
+	}
+	if child.underflows() && len(i.children) > 1 {
+		i.rebalance(index)
+	} else if i.recount(index) || i.childMoved(index) {
+		i.write()
 	}
-	i.keys = []uint64{parentKey}
-	i.children = []noder{left, right}
+	return true
+}
 
-	right.write()
-	left.write()
-	return i
+//childMoved says if the child at index is on a different page than the node points to.
+//That only happens in copy-on-write trees.
+func (i *interiorNode) childMoved(index int) bool {
+	return i.children[index].Page() != i.pages[index]
 }
 
-func (i *interiorNode) delete(key uint64) {
-	index := i.findIndexOfKey(key)
-	child := i.children[index]
-	child.delete(key)
-	if len(child.Keys()) < (NODE_ORDER/2)-1 {
-		updatedKeys := append(i.keys[:index], i.keys[index+1:]...)
-		i.keys = updatedKeys
-		updatedChildren := append(i.children[:index], i.children[index+1:]...)
-		i.children = updatedChildren
+//rebalance fixes the underflowing child at index by merging it with a sibling.
+//If the two don't fit in one node the keys are spread evenly between them instead.
+//The child is already write latched, the sibling gets latched here.
+func (i *interiorNode) rebalance(index int) {
+	child := i.child(index)
+	//pair the child with its left sibling if it has one
+	if index > 0 {
+		index--
+	}
+	sibling := i.child(index)
+	if sibling == child {
+		sibling = i.child(index + 1)
+	}
+	sibling.Lock()
+	defer sibling.Unlock()
+	switch left := i.child(index).(type) {
+	case *leafNode:
+		i.rebalanceLeaves(index, left, i.child(index+1).(*leafNode))
+	case *interiorNode:
+		i.rebalanceInteriors(index, left, i.child(index+1).(*interiorNode))
 	}
+	i.recount(index)
+	if index+1 < len(i.children) {
+		i.recount(index + 1)
+	}
+	i.write()
 }
 
-func (i *interiorNode) get(key uint64) []byte {
-	if !i.isFetched() {
-		i.Fetch(key)
+func (i *interiorNode) rebalanceLeaves(index int, left, right *leafNode) {
+	left.load()
+	right.load()
+	keys := append(append([][]byte{}, left.keys...), right.keys...)
+	values := append(append([][]byte{}, left.values...), right.values...)
+
+	if leafFits(keys, values) {
+		left.keys = keys
+		left.values = values
+		left.right = right.right
+		left.write()
+		i.tree.free(right.page)
+		i.removeChild(index)
+		i.tree.uncached(right)
+		return
 	}
-	index := i.findIndexOfKey(key)
-	child := i.children[index]
-	if child == nil {
-		//this is ugly.
-		//Right now the first fetch gets the keys
-		//and which ever pointer we need.
-		//We avoid fetching all pointers because we would need
-		//to know what type they are and that requires reading from disk
-		//To circumvent we read one pointer at a time except we allocate an array of children big enough to hold all of the children. This means the fetch condition is never triggered.
-		i.Fetch(key)
-		child = i.children[index]
+
+	sizes, room := leafCellSizes(keys, values)
+	m := splitIndex(sizes, halfOf(sizes), room)
+	left.keys, right.keys = keys[:m:m], keys[m:]
+	left.values, right.values = values[:m:m], values[m:]
+	i.keys[index] = i.tree.separator(keys[m-1], keys[m])
+	left.write()
+	right.write()
+}
+
+func (i *interiorNode) rebalanceInteriors(index int, left, right *interiorNode) {
+	left.load()
+	right.load()
+	//the separator comes down from the parent between the two halves
+	keys := append(append(append([][]byte{}, left.keys...), i.keys[index]), right.keys...)
+	children := append(append([]noder{}, left.children...), right.children...)
+	pages := append(append([]storage.Pager{}, left.pages...), right.pages...)
+	counts := append(append([]uint64{}, left.counts...), right.counts...)
+
+	if i.tree.interiorFits(keys) {
+		left.keys = keys
+		left.children = children
+		left.pages = pages
+		left.counts = counts
+		left.write()
+		i.tree.free(right.page)
+		i.removeChild(index)
+		i.tree.uncached(right)
+		left.reparent()
+		return
 	}
-	return child.get(key)
+
+	m := i.splitIndex(keys, true, false)
+	left.keys, right.keys = keys[:m:m], keys[m+1:]
+	left.children, right.children = children[:m+1:m+1], children[m+1:]
+	left.pages, right.pages = pages[:m+1:m+1], pages[m+1:]
+	left.counts, right.counts = counts[:m+1:m+1], counts[m+1:]
+	i.keys[index] = keys[m]
+	left.write()
+	right.write()
+	left.reparent()
+	right.reparent()
 }
 
-func (i *interiorNode) getLeft() *leafNode {
-	i.fetchIndex(0)
-	return i.children[0].getLeft()
+func (i *interiorNode) underflows() bool {
+	return i.tree.interiorCells(i.keys) < pageCapacity/4
 }
-func (i *interiorNode) getRight() *leafNode {
-	i.keys, _ = i.page.FetchInterior()
-	i.fetchIndex(len(i.keys))
-	return i.children[len(i.children)-1].getLeft()
+
+func (i *interiorNode) getLeft() *leafNode {
+	return i.child(0).getLeft()
 }
 
 func (i *interiorNode) write() {
-	var childPages []storage.Pager
-	var pages []storage.Pager
-	for j, c := range i.children {
-		var p storage.Pager
-		if c == nil {
-			if childPages == nil {
-				_, childPages = i.page.FetchInterior()
-			}
-			p = childPages[j]
-		} else {
+	i.tree.shadow(i)
+	pages := make([]storage.Pager, len(i.pages))
+	for j, p := range i.pages {
+		if c := i.children[j]; c != nil {
 			p = c.Page()
 		}
-		pages = append(pages, p)
+		pages[j] = p
 	}
-	i.page.WriteInterior(i.keys, pages)
+	i.pages = pages
+	i.page.WriteInterior(i.keys, pages, i.tree.storedCounts(i.counts))
 }
 func (i *interiorNode) Page() storage.Pager {
 	return i.page
 }
 
-func (i *interiorNode) findIndexOfKey(key uint64) int {
+func (i *interiorNode) setPage(p storage.Pager) {
+	i.page = p
+}
+
+func (i *interiorNode) findIndexOfKey(key []byte) int {
 	var index int = len(i.keys)
 	for x, k := range i.keys {
-		if key < (k) {
+		if i.tree.compare(key, k) < 0 {
 			index = x
 			break
 		}
@@ -150,7 +257,7 @@ func (i *interiorNode) findIndexOfKey(key uint64) int {
 	return index
 }
 
-func (i *interiorNode) Keys() []uint64 {
+func (i *interiorNode) Keys() [][]byte {
 	return i.keys
 }
 
@@ -166,42 +273,52 @@ func (i *interiorNode) _print() {
 
 }
 
-func (i *interiorNode) fetch(indexFunc func() int) {
-	keys, childPages := i.page.FetchInterior()
-	i.keys = keys
-	if len(i.children) < len(childPages) {
-		//if we don't have enough children
-		//we at least want enough spots to hold them
-		i.children = make([]noder, len(childPages))
-	}
-	index := indexFunc()
-	if i.children[index] != nil {
+//load reads the keys and child pointers the first time the node is used.
+//The children themselves are read one at a time by child.
+func (i *interiorNode) load() {
+	i.loading.Lock()
+	defer i.loading.Unlock()
+	if i.loaded {
 		return
 	}
-	childPage := childPages[index]
-
-	var child noder
-	switch childPage.Type() {
-	case storage.LEAF_NODE:
-		child = &leafNode{
-			page: childPage,
-		}
-	case storage.INTERIOR_NODE:
-		child = &interiorNode{
-			page: childPage,
-		}
+	i.keys, i.pages, i.counts = i.page.FetchInterior()
+	if i.counts == nil {
+		i.counts = make([]uint64, len(i.pages))
 	}
-	i.children[index] = child
+	i.children = make([]noder, len(i.pages))
+	i.loaded = true
 }
 
-func (i *interiorNode) Fetch(key uint64) {
-	i.fetch(func() int { return i.findIndexOfKey(key) })
-}
-
-func (i *interiorNode) fetchIndex(index int) {
-	i.fetch(func() int { return index })
+//child returns the child at index, reading it from disk if needed
+func (i *interiorNode) child(index int) noder {
+	i.load()
+	i.loading.Lock()
+	n := i.children[index]
+	read := n == nil
+	if read {
+		n = newNode(i.tree, i.pages[index])
+		i.children[index] = n
+	}
+	i.loading.Unlock()
+	if read {
+		i.tree.cached(n, i)
+	} else {
+		n.entry().referenced.Store(true)
+	}
+	return n
 }
 
-func (i *interiorNode) isFetched() bool {
-	return len(i.children) == len(i.keys)+1
+//newNode wraps a page in the right kind of node without reading its cells
+func newNode(t *BTree, p storage.Pager) noder {
+	switch p.Type() {
+	case storage.INTERIOR_NODE:
+		return &interiorNode{
+			page: p,
+			tree: t,
+		}
+	}
+	return &leafNode{
+		page: p,
+		tree: t,
+	}
 }
@@ -0,0 +1,65 @@
+package btree
+
+import (
+	"errors"
+	"iter"
+)
+
+/*
+All, Range and Backward let a tree with int keys be read with a for loop:
+
+	for k, v := range tree.Range(10, 20) {
+		...
+	}
+
+They use a Cursor so writes while the loop runs are handled the same way.
+A loop stops early if it finds a key that isn't an int key. To find out why
+pass an error for it to set, nil if the loop ran to the end or its body stopped it:
+
+	var err error
+	for k, v := range tree.All(&err) {
+		...
+	}
+
+Only the loop's own error is set so loops running at the same time don't see
+each other's, a loop run from several goroutines needs an error for each.
+*/
+
+var ErrNotIntKey = errors.New("btree: key isn't an int key")
+
+//All goes over every key and value in order
+func (t *BTree) All(err ...*error) iter.Seq2[uint64, []byte] {
+	return t.iterate((*Cursor).First, (*Cursor).Next, err)
+}
+
+//Range goes over the keys in [lo, hi) in order
+func (t *BTree) Range(lo, hi int, err ...*error) iter.Seq2[uint64, []byte] {
+	return t.iterate(func(c *Cursor) { c.Range(lo, hi) }, (*Cursor).Next, err)
+}
+
+//Backward goes over every key and value from the largest key down
+func (t *BTree) Backward(err ...*error) iter.Seq2[uint64, []byte] {
+	return t.iterate((*Cursor).Last, (*Cursor).Prev, err)
+}
+
+//iterate returns a loop that sets errs to why it stopped when it's done
+func (t *BTree) iterate(start func(*Cursor), next func(*Cursor), errs []*error) iter.Seq2[uint64, []byte] {
+	return func(yield func(uint64, []byte) bool) {
+		var stopped error
+		defer func() {
+			for _, err := range errs {
+				*err = stopped
+			}
+		}()
+		c := t.NewCursor()
+		for start(c); c.Available(); next(c) {
+			if len(c.KeyBytes()) != 8 {
+				stopped = ErrNotIntKey
+				return
+			}
+			if !yield(c.Key(), c.Data()) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package btree
+
+import (
+	"github.com/MattParker89/seaquell/storage"
+	"sync/atomic"
+)
+
+/*
+Latches:
+Every node has a read/write latch and the tree has one more for the root pointer,
+because the root node changes when the tree grows or shrinks.
+
+Readers crab down the tree: they read latch a child before letting go of its parent,
+so they never hold more than two latches and never see a node half written.
+
+Writers write latch their way down the same way but only let go of what is above
+a safe node. A node is safe if the insert or delete can't spread past it, that is
+an insert won't split it and a delete won't make it underflow. Everything above
+a safe node is left alone so other writers can go down the rest of the tree.
+In a tree that keeps counts every node on the way changes, none of them are safe.
+Rebalancing also needs a sibling, it gets latched by the parent, which the writer
+already holds.
+
+Latches are always taken from the top down so nobody waits on a latch held by
+someone waiting on them.
+
+Every change bumps the tree's version after its latches are taken and before
+anything is touched. Cursors don't hold latches between calls, if the version
+moved they seek again before trusting the nodes they remember.
+
+Nodes load their cells lazily. Several readers can hold the same read latch
+so loading has its own small mutex, see leafNode.Fetch and interiorNode.load.
+*/
+
+//latchRoot returns the root node read latched
+func (t *BTree) latchRoot() noder {
+	t.rootLatch.RLock()
+	defer t.rootLatch.RUnlock()
+	n := t.root
+	n.RLock()
+	return n
+}
+
+//readDown goes from n down to a leaf taking the child pick chooses at every interior node.
+//n must be read latched. The leaf is returned still read latched.
+func readDown(n noder, pick func(*interiorNode) int) *leafNode {
+	for {
+		n.load()
+		i, ok := n.(*interiorNode)
+		if !ok {
+			return n.(*leafNode)
+		}
+		child := i.child(pick(i))
+		child.RLock()
+		i.RUnlock()
+		n = child
+	}
+}
+
+//latchLeaf returns the leaf key belongs in, read latched
+func (t *BTree) latchLeaf(key []byte) *leafNode {
+	return readDown(t.latchRoot(), func(i *interiorNode) int {
+		return i.findIndexOfKey(key)
+	})
+}
+
+//writePath is what a writer has latched
+type writePath struct {
+	tree      *BTree
+	held      []noder //from the top most latched node down to the leaf
+	rootHeld  bool    //the root latch is still held, the root may change
+	appending bool    //the key goes after every key in the tree
+}
+
+//latchPath write latches the way down to the leaf key belongs in.
+//safe says if a node can't be changed by the children below it,
+//isRoot is set for the root node.
+func (t *BTree) latchPath(key []byte, safe func(n noder, isRoot bool) bool) *writePath {
+	if t.cow != nil {
+		//commits and rollbacks wait for writers to finish
+		t.cow.txn.RLock()
+	}
+	t.rootLatch.Lock()
+	w := &writePath{tree: t, rootHeld: true, appending: true}
+	n := t.root
+	n.Lock()
+	w.held = append(w.held, n)
+	isRoot := true
+	for {
+		n.load()
+		//in a copy-on-write tree a node that moves has to change its parent
+		if safe(n, isRoot) && !t.moves(n) && !t.counted {
+			w.releaseAbove()
+		}
+		i, ok := n.(*interiorNode)
+		if !ok {
+			break
+		}
+		index := i.findIndexOfKey(key)
+		if index < len(i.keys) {
+			w.appending = false
+		}
+		n = i.child(index)
+		n.Lock()
+		w.held = append(w.held, n)
+		isRoot = false
+	}
+	l := w.leaf()
+	if len(l.keys) > 0 && t.compare(key, l.keys[len(l.keys)-1]) <= 0 {
+		w.appending = false
+	}
+	//from here on what cursors remember may be wrong
+	atomic.AddUint64(&t.version, 1)
+	return w
+}
+
+//releaseAbove lets go of everything above the last latched node
+func (w *writePath) releaseAbove() {
+	last := len(w.held) - 1
+	for _, n := range w.held[:last] {
+		n.Unlock()
+	}
+	w.held = w.held[last:]
+	if w.rootHeld {
+		w.rootHeld = false
+		w.tree.rootLatch.Unlock()
+	}
+}
+
+func (w *writePath) release() {
+	for _, n := range w.held {
+		n.Unlock()
+	}
+	w.held = nil
+	if w.rootHeld {
+		w.rootHeld = false
+		w.tree.rootLatch.Unlock()
+	}
+	if w.tree.cow != nil {
+		w.tree.cow.txn.RUnlock()
+	}
+}
+
+//top is the node the change starts at
+func (w *writePath) top() noder {
+	return w.held[0]
+}
+
+func (w *writePath) leaf() *leafNode {
+	return w.held[len(w.held)-1].(*leafNode)
+}
+
+//insertSafe returns a function saying if a node can take the key without splitting.
+//Interior nodes have to have room for whatever key a child could push up,
+//it might not share their prefix so they're sized as if nothing was shared.
+func insertSafe(key []byte, value []byte) func(noder, bool) bool {
+	return func(n noder, isRoot bool) bool {
+		switch n := n.(type) {
+		case *leafNode:
+			keys, values := len(n.keys), len(n.values)
+			return leafFits(append(n.keys[:keys:keys], key), append(n.values[:values:values], value))
+		case *interiorNode:
+			return n.tree.interiorCells(n.keys)+pageCapacity/4 <= pageCapacity
+		}
+		return false
+	}
+}
+
+//deleteSafe returns a function saying if a node can lose a cell without underflowing.
+//Interior nodes have to have room to lose whatever key a merge below takes out.
+//The root doesn't underflow but an interior root left with no keys is replaced by its child.
+func deleteSafe(key []byte) func(noder, bool) bool {
+	return func(n noder, isRoot bool) bool {
+		switch n := n.(type) {
+		case *leafNode:
+			if isRoot {
+				return true
+			}
+			index, found := n.search(key)
+			if !found {
+				return true
+			}
+			cell := storage.LeafCellSize(n.keys[index], n.values[index])
+			return leafCells(n.keys, n.values)-cell >= pageCapacity/4
+		case *interiorNode:
+			if isRoot {
+				return len(n.keys) > 1
+			}
+			return n.tree.interiorCells(n.keys)-pageCapacity/4 >= pageCapacity/4
+		}
+		return false
+	}
+}
@@ -3,34 +3,45 @@ package btree
 import (
 	"fmt"
 	"github.com/MattParker89/seaquell/storage"
+	"sync"
 )
 
 type leafNode struct {
-	keys      []uint64
+	sync.RWMutex //latch
+	cacheEntry
+	keys      [][]byte
 	values    [][]byte
-	right     *leafNode
+	right     storage.Pager //the next leaf's page, nil for the last one
 	page      storage.Pager
 	isFetched bool
+	loading   sync.Mutex //guards isFetched while readers share the latch
+	tree      *BTree
 }
 
-func (l *leafNode) insert(key uint64, value []byte) *interiorNode {
+func (l *leafNode) insert(key []byte, value []byte, appending bool) ([]byte, noder) {
 	l.Fetch(key)
-	if len(l.keys) == 0 {
-		l.keys = append(l.keys, key)
-		l.values = append(l.values, value)
-		l.write()
-		return nil
+	l.put(key, value)
+
+	//if the node doesn't fit it's time to split
+	if !leafFits(l.keys, l.values) {
+		return l.split(appending)
 	}
-	var index int = len(l.keys)
-	for x, k := range l.keys {
-		if key <= (k) {
-			index = x
-			break
-		}
+	l.write()
+	return nil, nil
+
+}
+
+//put adds the key to the leaf's cells without writing them.
+//Keys are unique, if the key is there the new value replaces the old one.
+func (l *leafNode) put(key []byte, value []byte) {
+	index, found := l.search(key)
+	if found {
+		l.values[index] = value
+		return
 	}
 
 	oldKeys := l.keys
-	l.keys = make([]uint64, index)
+	l.keys = make([][]byte, index)
 	copy(l.keys[:index], oldKeys[:index])
 	l.keys = append(l.keys, key)
 	l.keys = append(l.keys, oldKeys[index:]...)
@@ -40,60 +51,44 @@ func (l *leafNode) insert(key uint64, value []byte) *interiorNode {
 	copy(l.values[:index], oldValues[:index])
 	l.values = append(l.values, value)
 	l.values = append(l.values, oldValues[index:]...)
-
-	keyLength := len(l.keys)
-
-	//if the key length >= NODE_ORDER it means we've passed our limit on values
-	//if m = len(values) then NODE_ORDER/2 <= m <= NODE_ORDER
-	if keyLength >= NODE_ORDER {
-		fmt.Println("split leaf")
-		return l.split()
-	}
-	l.write()
-	return nil
-
 }
 
 func (l *leafNode) write() {
+	l.tree.shadow(l)
 	var rightPtr storage.Pager
-	if l.right != nil {
-		fmt.Print("l.right is", l.right)
-		rightPtr = l.right.page
+	if l.right != nil && l.tree.siblingPointers() {
+		rightPtr = l.right
 	}
 	l.isFetched = true
 	l.page.WriteLeaf(l.keys, l.values, rightPtr)
 }
 
-func (l *leafNode) Keys() []uint64 {
+func (l *leafNode) Keys() [][]byte {
 	return l.keys
 }
 
-func (l *leafNode) split() *interiorNode {
-	keyLength := len(l.keys)
-	i := int(keyLength / 2)
-	newKeys := l.keys[i:]
-	newValues := l.values[i:]
-	l.keys = l.keys[:i]
-	l.values = l.values[:i]
+//split keeps the lower half of the keys on the current page
+//so the left sibling's right pointer stays valid.
+//It returns the key to promote and the new right leaf.
+func (l *leafNode) split(appending bool) ([]byte, noder) {
+	sizes, room := leafCellSizes(l.keys, l.values)
+	i := splitIndex(sizes, l.tree.splitTarget(sizes, appending), room)
 
 	newLeaf := &leafNode{
-		keys:   newKeys,
-		values: newValues,
+		keys:   append([][]byte{}, l.keys[i:]...),
+		values: append([][]byte{}, l.values[i:]...),
 		right:  l.right,
-		page:   storage.NewPage(),
+		page:   l.tree.newPage(l.page),
+		tree:   l.tree,
 	}
-	l.right = newLeaf
+	l.keys = l.keys[:i]
+	l.values = l.values[:i]
+	l.right = newLeaf.page
 
-	parent := &interiorNode{
-		keys:     []uint64{newLeaf.keys[0]},
-		children: []noder{l, newLeaf},
-		page:     l.page, //the promoted node keeps the current page since it might be root
-	}
-	l.page = storage.NewPage()
-	l.write()
 	newLeaf.write()
+	l.write()
 
-	return parent
+	return l.tree.separator(l.keys[i-1], newLeaf.keys[0]), newLeaf
 }
 
 func (l *leafNode) _print() {
@@ -105,7 +100,17 @@ func (l *leafNode) Page() storage.Pager {
 	return l.page
 }
 
-func (l *leafNode) Fetch(key uint64) {
+func (l *leafNode) setPage(p storage.Pager) {
+	l.page = p
+}
+
+func (l *leafNode) load() {
+	l.Fetch(nil)
+}
+
+func (l *leafNode) Fetch(key []byte) {
+	l.loading.Lock()
+	defer l.loading.Unlock()
 	if l.isFetched {
 		return
 	}
@@ -115,56 +120,47 @@ func (l *leafNode) Fetch(key uint64) {
 	}
 	l.keys = keys
 	l.values = vals
-	if rightPage != nil {
-		l.right = &leafNode{page: rightPage}
-	}
+	l.right = rightPage
 	l.isFetched = true
 }
 
-func (l *leafNode) delete(key uint64) {
-	index := l.findIndexOfKey(key)
-	if len(l.keys) == 1 {
-		l.keys = []uint64{}
-		l.values = [][]byte{}
-		return
+//delete removes the key and writes the leaf.
+//It returns false if the key isn't in the leaf.
+func (l *leafNode) delete(key []byte) bool {
+	l.Fetch(key)
+	index, found := l.search(key)
+	if !found {
+		return false
 	}
-	updatedKeys := append(l.keys[:index], l.keys[index+1:]...)
-	l.keys = updatedKeys
-	updatedValues := append(l.values[:index], l.values[index+1:]...)
-	l.values = updatedValues
+	l.keys = append(l.keys[:index], l.keys[index+1:]...)
+	l.values = append(l.values[:index], l.values[index+1:]...)
+	l.write()
+	return true
 }
 
-func (l *leafNode) get(key uint64) []byte {
-	l.Fetch(key)
+func (l *leafNode) underflows() bool {
+	return leafCells(l.keys, l.values) < pageCapacity/4
+}
 
-	index := l.findIndexOfKey(key)
-	return l.values[index]
+func (l *leafNode) get(key []byte) ([]byte, bool) {
+	l.Fetch(key)
+	index, found := l.search(key)
+	if !found {
+		return nil, false
+	}
+	return l.values[index], true
 }
 
 func (l *leafNode) getLeft() *leafNode {
 	return l
 }
-func (l *leafNode) getRight() *leafNode {
-	return l
-}
-
-func (l *leafNode) getValueAtIndex(index int) []byte {
-	l.Fetch(0)
-	return l.values[index]
-}
-
-func (l *leafNode) getKeyAtIndex(index int) uint64 {
-	l.Fetch(0)
-	return l.keys[index]
-}
 
-func (l *leafNode) findIndexOfKey(key uint64) int {
-	var index int = len(l.keys) - 1
+//search returns the index of the first key >= key and whether it is an exact match
+func (l *leafNode) search(key []byte) (int, bool) {
 	for x, k := range l.keys {
-		if key == k {
-			index = x
-			break
+		if c := l.tree.compare(k, key); c >= 0 {
+			return x, c == 0
 		}
 	}
-	return index
+	return len(l.keys), false
 }
@@ -9,20 +9,23 @@ import (
 type MockPager struct {
 }
 
-func (m *MockPager) WriteLeaf(keys []uint64, values [][]byte, rightPtr uint64) {
+func (m *MockPager) WriteLeaf(keys [][]byte, values [][]byte, rightPtr storage.Pager) {
 
 }
-func (m *MockPager) WriteInterior(keys []uint64, children []storage.Pager) {
+func (m *MockPager) WriteInterior(keys [][]byte, children []storage.Pager, counts []uint64) {
 
 }
 func (m *MockPager) Create() storage.Pager {
 	return &MockPager{}
 }
-func (m *MockPager) FetchInterior() ([]uint64, []storage.Pager) {
-	return []uint64{}, []storage.Pager{}
+func (m *MockPager) At(offset uint64) storage.Pager {
+	return &MockPager{}
+}
+func (m *MockPager) FetchInterior() ([][]byte, []storage.Pager, []uint64) {
+	return [][]byte{}, []storage.Pager{}, nil
 }
-func (m *MockPager) FetchLeaf() ([]uint64, [][]byte) {
-	return []uint64{}, [][]byte{}
+func (m *MockPager) FetchLeaf() ([][]byte, [][]byte, storage.Pager) {
+	return [][]byte{}, [][]byte{}, nil
 }
 func (m *MockPager) Free() {
 
@@ -33,32 +36,46 @@ func (m *MockPager) Offset() uint64 {
 func (m *MockPager) Type() storage.NodeType {
 	return storage.LEAF_NODE
 }
+func (m *MockPager) NumberOfKeys() uint16 {
+	return 0
+}
 
-func Test_Leaf_findIndexOfKey(t *testing.T) {
+func Test_Leaf_search(t *testing.T) {
 	l := &leafNode{
-		keys: []uint64{0, 1, 2, 3, 4},
+		keys: [][]byte{{0}, {1}, {3}, {4}},
 	}
-	i := l.findIndexOfKey(3)
-	if i != 3 {
-		t.Error("wrong index returned", i)
+	i, found := l.search([]byte{3})
+	if i != 2 || !found {
+		t.Error("wrong index returned", i, found)
+	}
+	i, found = l.search([]byte{2})
+	if i != 2 || found {
+		t.Error("missing key found", i, found)
+	}
+	if i, found = l.search([]byte{5}); i != 4 || found {
+		t.Error("missing key found", i, found)
 	}
 }
 
 func Test_Leaf_get_no_fetch(t *testing.T) {
 	selectedVal := []byte{2}
 	l := &leafNode{
-		keys:   []uint64{0, 1, 2, 3, 4},
-		values: [][]byte{[]byte{0}, []byte{1}, selectedVal, []byte{3}},
+		keys:      [][]byte{{0}, {1}, {2}, {3}, {4}},
+		values:    [][]byte{[]byte{0}, []byte{1}, selectedVal, []byte{3}},
+		isFetched: true,
 	}
-	val := l.get(2)
-	if !bytes.Equal(selectedVal, val) {
+	val, found := l.get([]byte{2})
+	if !found || !bytes.Equal(selectedVal, val) {
 		t.Errorf("Expected %v; got %v", selectedVal, val)
 	}
+	if val, found := l.get([]byte{7}); found {
+		t.Errorf("Expected a missing key; got %v", val)
+	}
 
 }
 
 func Test_split(t *testing.T) {
-	keys := []uint64{0, 1, 2, 3}
+	keys := [][]byte{{0}, {1}, {2}, {3}}
 	vals := [][]byte{[]byte{0}, []byte{1}, []byte{2}, []byte{3}}
 
 	l := &leafNode{
@@ -66,22 +83,22 @@ func Test_split(t *testing.T) {
 		values: vals,
 		page:   &MockPager{},
 	}
-	parent := l.split()
-	if len(parent.children) != 2 {
-		t.Error("not split in two")
+	key, right := l.split(false)
+	if right == nil || len(l.keys)+len(right.Keys()) != len(keys) {
+		t.Fatal("not split in two")
 	}
 	for i := 0; i < len(keys)/2; i++ {
-		if parent.children[0].Keys()[i] != keys[i] {
+		if !bytes.Equal(l.Keys()[i], keys[i]) {
 			t.Error("split incorrectly")
 		}
 	}
 	for i := 0; i < len(keys)/2; i++ {
-		if parent.children[1].Keys()[i] != keys[i+(len(keys)/2)] {
+		if !bytes.Equal(right.Keys()[i], keys[i+(len(keys)/2)]) {
 			t.Error("split incorrectly")
 		}
 	}
 
-	if parent.keys[0] != parent.children[1].Keys()[0] {
+	if !bytes.Equal(key, right.Keys()[0]) {
 		t.Error("split on wrong key")
 	}
 
@@ -0,0 +1,342 @@
+package btree
+
+import (
+	"errors"
+	"github.com/MattParker89/seaquell/storage"
+	"sync/atomic"
+)
+
+/*
+A Loader builds a tree bottom up from keys that arrive in ascending order.
+Leaves are filled one after another and written once, each full leaf adds
+a child to the level above it, which fills the same way. Nothing is ever
+searched for or written twice, unlike calling Insert for every row.
+
+Each level holds back its last full node. When the load finishes the last
+two nodes of a level are merged, or evened out if they don't fit in one,
+so no node is left less than a quarter full.
+
+Pages are packed full unless the tree has a fill factor, then they are
+filled to that so later inserts have room. Keys arrive sorted so the prefix
+a node's keys share is the one its first and last keys share.
+
+The loader holds the root latch from NewLoader until Finish or Cancel, so the
+tree stays empty while pages are written and nobody else can use it meanwhile.
+*/
+
+var ErrNotSorted = errors.New("btree: keys must be loaded in ascending order")
+var ErrNotEmpty = errors.New("btree: bulk loads need an empty tree")
+
+//Loader isn't safe for use by more than one goroutine
+type Loader struct {
+	tree    *BTree
+	page    storage.Pager //the tree's root page, new pages are created next to it
+	levels  []*loadLevel  //the leaves first, the root's level last
+	last    []byte        //the last key added
+	started bool
+	written []storage.Pager //pages created so far, Cancel frees them
+	done    bool            //the tree has been let go
+}
+
+type loadLevel struct {
+	tree    *BTree
+	leaf    bool
+	pending *loadNode //full and waiting for the node after it
+	current *loadNode
+	pushed  bool   //a node from this level has been added to the level above
+	last    []byte //leaves only, the last key of the node pushed last
+}
+
+type loadNode struct {
+	first  []byte //the smallest key under the node
+	keys   [][]byte
+	values [][]byte        //leaves only
+	pages  []storage.Pager //interiors only, one more than keys
+	counts []uint64        //interiors only, the rows under each page
+	cells  int             //what the cells take up without a shared prefix
+	page   storage.Pager   //nil until something needs to point at it
+}
+
+//NewLoader returns a Loader for the tree. The tree has to be empty.
+//Until the Loader is finished or cancelled every other use of the tree waits.
+func (t *BTree) NewLoader() (*Loader, error) {
+	if t.cow != nil {
+		t.cow.txn.RLock()
+	}
+	t.rootLatch.Lock()
+	root := t.root
+	root.RLock()
+	root.load()
+	l, ok := root.(*leafNode)
+	empty := ok && len(l.keys) == 0
+	root.RUnlock()
+
+	loader := &Loader{tree: t, page: root.Page()}
+	if !empty {
+		loader.release()
+		return nil, ErrNotEmpty
+	}
+	return loader, nil
+}
+
+//Add appends a key and its value. Keys must be larger than the one before.
+//Nothing is visible in the tree until Finish is called.
+func (l *Loader) Add(key []byte, value []byte) error {
+	if storage.LeafCellSize(key, value) > pageCapacity/4 {
+		return ErrValueTooLarge
+	}
+	if l.started && l.tree.compare(key, l.last) <= 0 {
+		return ErrNotSorted
+	}
+	l.last = key
+	l.started = true
+	l.add(0, &loadNode{first: key, keys: [][]byte{key}, values: [][]byte{value}})
+	return nil
+}
+
+//Finish writes what is left and makes the loaded pages the tree.
+//It can be called after Add failed, the keys added before are kept.
+func (l *Loader) Finish() error {
+	if l.done {
+		return nil
+	}
+	defer l.release()
+	t := l.tree
+	if !l.started {
+		return nil
+	}
+	root := t.root
+	root.Lock()
+	defer root.Unlock()
+	atomic.AddUint64(&t.version, 1)
+
+	rootPage := root.Page()
+	if t.moves(root) {
+		//the empty root belongs to a committed version
+		rootPage = t.newPage(rootPage)
+	}
+	for i := 0; i < len(l.levels); i++ {
+		level := l.levels[i]
+		nodes := level.finish()
+		if !level.pushed && len(nodes) == 1 {
+			//the only node left on the top level goes on the tree's root page
+			nodes[0].page = rootPage
+			l.write(level, nodes[0], nil)
+			break
+		}
+		if len(nodes) == 2 {
+			l.write(level, nodes[0], nodes[1])
+		}
+		l.write(level, nodes[len(nodes)-1], nil)
+		for _, n := range nodes {
+			l.push(i, n)
+		}
+	}
+
+	t.root = newNode(t, rootPage)
+	t.root.load()
+	return nil
+}
+
+//Cancel throws away what was added and frees its pages, the tree stays empty
+func (l *Loader) Cancel() {
+	if l.done {
+		return
+	}
+	for _, p := range l.written {
+		l.tree.free(p)
+	}
+	l.written = nil
+	l.release()
+}
+
+//release lets other users have the tree again
+func (l *Loader) release() {
+	l.done = true
+	l.tree.rootLatch.Unlock()
+	if l.tree.cow != nil {
+		l.tree.cow.txn.RUnlock()
+	}
+}
+
+//newPage creates a page for the load near the root page
+func (l *Loader) newPage() storage.Pager {
+	p := l.tree.newPage(l.page)
+	l.written = append(l.written, p)
+	return p
+}
+
+//add puts a cell, or for interiors a child, on the level's current node.
+//If it doesn't fit the current node is held back and a new one started.
+func (l *Loader) add(index int, cell *loadNode) {
+	if index == len(l.levels) {
+		l.levels = append(l.levels, &loadLevel{tree: l.tree, leaf: index == 0})
+	}
+	level := l.levels[index]
+	if level.current == nil {
+		level.current = level.newNode(cell)
+		return
+	}
+	if level.sizeWith(level.current, cell) > l.tree.loadTarget() {
+		if level.pending != nil {
+			l.write(level, level.pending, level.current)
+			l.push(index, level.pending)
+		}
+		level.pending = level.current
+		level.current = level.newNode(cell)
+		return
+	}
+	level.current.append(level.leaf, cell)
+	level.current.cells += level.cellSize(cell)
+}
+
+//push adds a written node as a child on the level above.
+//The key in front of a leaf only has to be larger than the leaf before it.
+func (l *Loader) push(index int, n *loadNode) {
+	level := l.levels[index]
+	level.pushed = true
+	first := n.first
+	if level.leaf {
+		if level.last != nil {
+			first = l.tree.separator(level.last, n.first)
+		}
+		level.last = n.keys[len(n.keys)-1]
+	}
+	l.add(index+1, &loadNode{first: first, pages: []storage.Pager{n.page}, counts: []uint64{n.rows()}})
+}
+
+//write puts the node on its page. For leaves right is the next leaf.
+func (l *Loader) write(level *loadLevel, n *loadNode, right *loadNode) {
+	if n.page == nil {
+		n.page = l.newPage()
+	}
+	if !level.leaf {
+		n.page.WriteInterior(n.keys, n.pages, l.tree.storedCounts(n.counts))
+		return
+	}
+	var rightPtr storage.Pager
+	if right != nil {
+		if right.page == nil {
+			right.page = l.newPage()
+		}
+		rightPtr = right.page
+	}
+	n.page.WriteLeaf(n.keys, n.values, rightPtr)
+}
+
+func (level *loadLevel) newNode(cell *loadNode) *loadNode {
+	n := &loadNode{first: cell.first}
+	n.append(level.leaf, cell)
+	n.cells = level.tree.interiorSize(nil) //the first child has no key in front of it
+	if level.leaf {
+		n.cells = level.cellSize(cell)
+	}
+	return n
+}
+
+//size is what the node takes up on its page
+func (n *loadNode) size() int {
+	if len(n.keys) == 0 {
+		return n.cells
+	}
+	prefix := len(storage.CommonPrefix([][]byte{n.keys[0], n.keys[len(n.keys)-1]}))
+	return n.cells - prefix*len(n.keys) + prefix
+}
+
+//sizeWith is what the node would take up with the cell added
+func (level *loadLevel) sizeWith(n *loadNode, cell *loadNode) int {
+	key := cell.first
+	first := key
+	if len(n.keys) > 0 {
+		first = n.keys[0]
+	}
+	prefix := len(storage.CommonPrefix([][]byte{first, key}))
+	return n.cells + level.cellSize(cell) - prefix*(len(n.keys)+1) + prefix
+}
+
+//cellSize is what adding the cell costs the node it goes on
+func (level *loadLevel) cellSize(cell *loadNode) int {
+	if level.leaf {
+		return storage.LeafCellSize(cell.keys[0], cell.values[0])
+	}
+	return level.tree.interiorCellSize(cell.first)
+}
+
+//rows is how many keys are under the node
+func (n *loadNode) rows() uint64 {
+	if n.pages == nil {
+		return uint64(len(n.keys))
+	}
+	var rows uint64
+	for _, c := range n.counts {
+		rows += c
+	}
+	return rows
+}
+
+func (n *loadNode) append(leaf bool, cell *loadNode) {
+	if leaf {
+		n.keys = append(n.keys, cell.keys[0])
+		n.values = append(n.values, cell.values[0])
+		return
+	}
+	if len(n.pages) > 0 {
+		n.keys = append(n.keys, cell.first)
+	}
+	n.pages = append(n.pages, cell.pages[0])
+	n.counts = append(n.counts, cell.counts[0])
+}
+
+//finish returns the level's last nodes, merged into one
+//or evened out if the last one would underflow
+func (level *loadLevel) finish() []*loadNode {
+	left, right := level.pending, level.current
+	if left == nil {
+		return []*loadNode{right}
+	}
+	if right.size() >= pageCapacity/4 {
+		return []*loadNode{left, right}
+	}
+
+	if level.leaf {
+		keys := append(append([][]byte{}, left.keys...), right.keys...)
+		values := append(append([][]byte{}, left.values...), right.values...)
+		if leafFits(keys, values) {
+			left.keys, left.values = keys, values
+			return []*loadNode{left}
+		}
+		sizes, room := leafCellSizes(keys, values)
+		m := splitIndex(sizes, halfOf(sizes), room)
+		left.keys, right.keys = keys[:m:m], keys[m:]
+		left.values, right.values = values[:m:m], values[m:]
+		right.first = right.keys[0]
+		return []*loadNode{left, right}
+	}
+
+	//the right node's first key comes between the two halves
+	keys := append(append(append([][]byte{}, left.keys...), right.first), right.keys...)
+	pages := append(append([]storage.Pager{}, left.pages...), right.pages...)
+	counts := append(append([]uint64{}, left.counts...), right.counts...)
+	if level.tree.interiorFits(keys) {
+		left.keys, left.pages, left.counts = keys, pages, counts
+		return []*loadNode{left}
+	}
+	sizes, room := level.tree.interiorCellSizes(keys)
+	m := splitIndex(sizes, halfOf(sizes), room)
+	if m >= len(keys)-1 {
+		m = len(keys) - 2
+	}
+	left.keys, right.keys = keys[:m:m], keys[m+1:]
+	left.pages, right.pages = pages[:m+1:m+1], pages[m+1:]
+	left.counts, right.counts = counts[:m+1:m+1], counts[m+1:]
+	right.first = keys[m]
+	return []*loadNode{left, right}
+}
+
+//loadTarget returns how many bytes a bulk load puts in a node
+func (t *BTree) loadTarget() int {
+	if t.fillFactor == 0 {
+		return pageCapacity
+	}
+	return int(t.fillFactor * float64(pageCapacity))
+}
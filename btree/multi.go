@@ -0,0 +1,131 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+/*
+Multimap:
+A secondary index holds the same key for many rows. A Multimap keeps
+a key as many times as it's given one by putting a row id after it, so
+every entry is unique and the entries of a key sit together in row id order.
+Row ids that only go up keep them in insertion order as well.
+
+The key and the row id can't be compared as one byte string, keys have
+different lengths, so the tree's comparator compares the keys first and
+the row ids after. Like any comparator it isn't stored, a fetched tree
+has to be wrapped with NewMultimap again.
+*/
+
+//Multimap is a tree whose keys can be in it more than once, told apart by row id
+type Multimap struct {
+	tree *BTree
+	keys Comparator //orders the keys without their row ids, nil means bytes.Compare
+}
+
+//EntryCursor goes over the entries of one key in row id order
+type EntryCursor struct {
+	multimap *Multimap
+	cursor   *Cursor
+	key      []byte
+}
+
+const row_id_size = 8
+
+//NewMultimap makes t a multimap. If t has a comparator it orders the keys.
+//It has to be called before the tree is shared between goroutines.
+func NewMultimap(t *BTree) *Multimap {
+	m := &Multimap{tree: t, keys: t.comparator}
+	t.SetComparator(func(a, b []byte) int {
+		keyA, rowA := SplitEntry(a)
+		keyB, rowB := SplitEntry(b)
+		if c := m.compare(keyA, keyB); c != 0 {
+			return c
+		}
+		switch {
+		case rowA < rowB:
+			return -1
+		case rowA > rowB:
+			return 1
+		}
+		return 0
+	})
+	return m
+}
+
+func (m *Multimap) compare(a, b []byte) int {
+	if m.keys == nil {
+		return bytes.Compare(a, b)
+	}
+	return m.keys(a, b)
+}
+
+//Tree returns the tree the entries are in
+func (m *Multimap) Tree() *BTree {
+	return m.tree
+}
+
+//Entry returns the key the tree stores for key and row id
+func Entry(key []byte, rowID uint64) []byte {
+	entry := make([]byte, len(key)+row_id_size)
+	copy(entry, key)
+	binary.BigEndian.PutUint64(entry[len(key):], rowID)
+	return entry
+}
+
+//SplitEntry returns the key and row id of a key from a multimap's tree
+func SplitEntry(entry []byte) ([]byte, uint64) {
+	if len(entry) < row_id_size {
+		return entry, 0
+	}
+	key := len(entry) - row_id_size
+	return entry[:key], binary.BigEndian.Uint64(entry[key:])
+}
+
+//Insert adds an entry for key, replacing the value if the key already has one with the row id
+func (m *Multimap) Insert(key []byte, rowID uint64, value []byte) error {
+	return m.tree.InsertKey(Entry(key, rowID), value)
+}
+
+//Get returns the value of key's entry with the row id and false if there isn't one
+func (m *Multimap) Get(key []byte, rowID uint64) ([]byte, bool) {
+	return m.tree.GetKey(Entry(key, rowID))
+}
+
+//Delete removes key's entry with the row id and returns false if there wasn't one.
+//The key's other entries stay.
+func (m *Multimap) Delete(key []byte, rowID uint64) bool {
+	return m.tree.DeleteKey(Entry(key, rowID))
+}
+
+//Entries returns a cursor on the first entry of key.
+//It isn't available if key has no entries.
+func (m *Multimap) Entries(key []byte) *EntryCursor {
+	c := &EntryCursor{multimap: m, cursor: m.tree.NewCursor(), key: key}
+	c.cursor.SeekKey(Entry(key, 0))
+	return c
+}
+
+func (c *EntryCursor) Available() bool {
+	if !c.cursor.Available() {
+		return false
+	}
+	key, _ := SplitEntry(c.cursor.KeyBytes())
+	return c.multimap.compare(key, c.key) == 0
+}
+
+func (c *EntryCursor) Next() {
+	c.cursor.Next()
+}
+
+//RowID returns the row id of the entry at the cursor
+func (c *EntryCursor) RowID() uint64 {
+	_, rowID := SplitEntry(c.cursor.KeyBytes())
+	return rowID
+}
+
+//Data returns the value of the entry at the cursor or nil if it has been deleted since
+func (c *EntryCursor) Data() []byte {
+	return c.cursor.Data()
+}
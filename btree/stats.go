@@ -0,0 +1,56 @@
+package btree
+
+import (
+	"github.com/MattParker89/seaquell/storage"
+)
+
+//Stats describes the shape of a tree, see BTree.Stats
+type Stats struct {
+	Depth        int     //levels in the tree, a tree that is only a leaf has a depth of 1
+	Interiors    int     //interior nodes
+	Leaves       int     //leaf nodes
+	Keys         int     //keys in the leaves
+	Fill         float64 //how much of a page the nodes use on average, from 0 to 1
+	PayloadBytes int     //the bytes of every key and value, without any page overhead
+}
+
+//Stats walks the whole tree and counts what is in it.
+//Writers wait for it but it can run alongside readers.
+func (t *BTree) Stats() Stats {
+	t.rootLatch.RLock()
+	var s Stats
+	var used int
+	s.count(t.root, 1, &used)
+	t.rootLatch.RUnlock()
+	//the children of the node being counted couldn't be evicted while it was
+	t.evict()
+	if nodes := s.Interiors + s.Leaves; nodes > 0 {
+		s.Fill = float64(used) / float64(nodes*pageCapacity)
+	}
+	return s
+}
+
+//count adds n and everything under it, used adds up the bytes the nodes take up
+func (s *Stats) count(n noder, depth int, used *int) {
+	n.RLock()
+	defer n.RUnlock()
+	n.load()
+	if depth > s.Depth {
+		s.Depth = depth
+	}
+	switch n := n.(type) {
+	case *leafNode:
+		s.Leaves++
+		s.Keys += len(n.keys)
+		*used += storage.LeafSize(n.keys, n.values)
+		for x, k := range n.keys {
+			s.PayloadBytes += len(k) + len(n.values[x])
+		}
+	case *interiorNode:
+		s.Interiors++
+		*used += n.tree.interiorSize(n.keys)
+		for x := range n.children {
+			s.count(n.child(x), depth+1, used)
+		}
+	}
+}
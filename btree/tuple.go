@@ -0,0 +1,188 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/*
+Tuples:
+EncodeTuple turns a row of values into a key whose byte order is SQL order,
+so a tree with the default comparator keeps multi-column keys sorted.
+Columns are compared left to right, a tuple that is a prefix of another
+sorts first.
+
+Every value starts with a tag, the tags put NULL before numbers,
+numbers before text and text before blobs.
+
+Numbers:
+int64 and float64 are compared by value like SQL does, 1 and 1.0 are the
+same key. The value goes in as a float64 with its bits flipped to sort as bytes
+(negative numbers have every bit flipped, others only the sign bit).
+After it come 2 bytes biased by 0x8000 with what rounding lost, 0 unless
+it's an int a float64 can't hold exactly. Which type it was isn't kept,
+whole numbers an int64 can hold come back as int64 and the rest as float64.
+-0 is stored as 0. Every NaN is stored as the same one and sorts after +Inf.
+
+Text and blobs:
+The bytes with every 0x00 written as 0x00 0xFF, ended by 0x00 0x01.
+The end sorts before any byte that can follow it so "ab" comes before "abc".
+*/
+
+var ErrTupleType = errors.New("btree: tuples can only hold int64, float64, string, []byte and nil")
+var ErrBadTuple = errors.New("btree: bytes aren't an encoded tuple")
+
+const (
+	tag_null   = 0x05
+	tag_number = 0x15
+	tag_text   = 0x25
+	tag_blob   = 0x35
+
+	number_size    = 10 //the float64 and the remainder
+	remainder_bias = 0x8000
+	canonical_nan  = 0x7FF8000000000000
+)
+
+//EncodeTuple returns a key for the values that sorts the way SQL orders them
+func EncodeTuple(values ...interface{}) ([]byte, error) {
+	var b []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			b = append(b, tag_null)
+		case int64:
+			b = appendNumber(b, float64(v), intRemainder(v))
+		case float64:
+			b = appendNumber(b, v, 0)
+		case string:
+			b = appendBytes(append(b, tag_text), []byte(v))
+		case []byte:
+			b = appendBytes(append(b, tag_blob), v)
+		default:
+			return nil, fmt.Errorf("%w, not %T", ErrTupleType, v)
+		}
+	}
+	return b, nil
+}
+
+//DecodeTuple returns the values EncodeTuple was given.
+//Whole numbers come back as int64 if they fit, other numbers as float64,
+//text as string and blobs as []byte.
+func DecodeTuple(key []byte) ([]interface{}, error) {
+	values := []interface{}{}
+	for len(key) > 0 {
+		tag := key[0]
+		key = key[1:]
+		switch tag {
+		case tag_null:
+			values = append(values, nil)
+		case tag_number:
+			if len(key) < number_size {
+				return nil, ErrBadTuple
+			}
+			bits := binary.BigEndian.Uint64(key)
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			f := math.Float64frombits(bits)
+			remainder := int64(binary.BigEndian.Uint16(key[8:])) - remainder_bias
+			if remainder != 0 || isInt(f) {
+				values = append(values, floatToInt(f)+remainder)
+			} else {
+				values = append(values, f)
+			}
+			key = key[number_size:]
+		case tag_text, tag_blob:
+			b, rest, err := readBytes(key)
+			if err != nil {
+				return nil, err
+			}
+			key = rest
+			if tag == tag_text {
+				values = append(values, string(b))
+			} else {
+				values = append(values, b)
+			}
+		default:
+			return nil, ErrBadTuple
+		}
+	}
+	return values, nil
+}
+
+func appendNumber(b []byte, f float64, remainder int64) []byte {
+	if f == 0 {
+		//-0 and 0 are the same number
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if math.IsNaN(f) {
+		//NaNs have a sign and a payload, either would make them different keys
+		bits = canonical_nan
+	}
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	b = append(b, tag_number)
+	b = binary.BigEndian.AppendUint64(b, bits)
+	return binary.BigEndian.AppendUint16(b, uint16(remainder+remainder_bias))
+}
+
+//intRemainder is what converting i to a float64 lost, i - int64(float64(i)).
+//Above 2^53 floats are 2^11 apart at most so it always fits in 2 bytes.
+func intRemainder(i int64) int64 {
+	return i - floatToInt(float64(i))
+}
+
+//isInt says if f is a whole number an int64 can hold.
+//2^63 isn't, an int64 that rounded to it has a remainder.
+func isInt(f float64) bool {
+	return f == math.Trunc(f) && f >= math.MinInt64 && f < math.MaxInt64
+}
+
+//floatToInt converts a float64 that came from an int64 back.
+//2^63 is the one float64 an int64 rounds to that int64 can't hold,
+//it is kept as MaxInt64 + 1 by wrapping around, remainders put it right.
+func floatToInt(f float64) int64 {
+	if f >= math.MaxInt64 {
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+func appendBytes(b []byte, value []byte) []byte {
+	for _, c := range value {
+		b = append(b, c)
+		if c == 0x00 {
+			b = append(b, 0xFF)
+		}
+	}
+	return append(b, 0x00, 0x01)
+}
+
+//readBytes reads bytes written by appendBytes and returns them and what comes after them
+func readBytes(key []byte) ([]byte, []byte, error) {
+	b := []byte{}
+	for x := 0; x+1 < len(key); x++ {
+		if key[x] != 0x00 {
+			b = append(b, key[x])
+			continue
+		}
+		switch key[x+1] {
+		case 0xFF:
+			b = append(b, 0x00)
+			x++
+		case 0x01:
+			return b, key[x+2:], nil
+		default:
+			return nil, nil, ErrBadTuple
+		}
+	}
+	return nil, nil, ErrBadTuple
+}
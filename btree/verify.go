@@ -0,0 +1,164 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MattParker89/seaquell/storage"
+	"strconv"
+)
+
+/*
+Verify walks the whole tree and checks it holds together:
+- keys are sorted in every node
+- every key sits between the separators its parents have on either side of it
+- interior nodes point at the pages their children are on
+- every leaf is at the same depth
+- each leaf's right pointer is the next leaf, the last one has none
+- no node is over a page or, apart from the root, under a quarter of one
+- if the tree keeps counts, every count is the number of keys under its child
+
+Appends split nodes as late as they can and leave the new right node nearly empty,
+so nodes on the right edge of the tree may be under a quarter full.
+
+It returns nil if nothing is wrong, otherwise one error listing everything that is.
+Writers wait for it but it can run alongside readers.
+*/
+func (t *BTree) Verify() error {
+	t.rootLatch.RLock()
+	v := &verifier{tree: t, depth: -1}
+	v.node(t.root, nil, nil, 0, true)
+	t.rootLatch.RUnlock()
+	v.siblings()
+	t.evict()
+	return errors.Join(v.errs...)
+}
+
+type verifier struct {
+	tree   *BTree
+	depth  int      //of the first leaf found, -1 until then
+	leaves []uint64 //page offsets of the leaves in order
+	rights []uint64 //the page each leaf's right pointer is, 0 for none
+	errs   []error
+}
+
+func (v *verifier) report(n noder, format string, args ...interface{}) {
+	v.errs = append(v.errs, fmt.Errorf("btree: page %d: %s", storage.PageNumber(n.Page().Offset()), fmt.Sprintf(format, args...)))
+}
+
+//node checks n and everything under it and returns how many keys that is.
+//lo and hi are the separators either side of n, nil if there isn't one.
+//rightEdge is set when n is the last node of its level.
+func (v *verifier) node(n noder, lo []byte, hi []byte, depth int, rightEdge bool) uint64 {
+	n.RLock()
+	defer n.RUnlock()
+	n.load()
+	isRoot := depth == 0
+
+	switch n := n.(type) {
+	case *leafNode:
+		v.keys(n, n.keys, lo, hi)
+		if len(n.values) != len(n.keys) {
+			v.report(n, "%d keys but %d values", len(n.keys), len(n.values))
+			return uint64(len(n.keys))
+		}
+		if !leafFits(n.keys, n.values) {
+			v.report(n, "leaf is over capacity")
+		}
+		if !isRoot && !rightEdge && n.underflows() {
+			v.report(n, "leaf is under capacity")
+		}
+		if !isRoot && len(n.keys) == 0 {
+			v.report(n, "leaf is empty")
+		}
+		if v.depth == -1 {
+			v.depth = depth
+		} else if depth != v.depth {
+			v.report(n, "leaf is at depth %d, the first one is at %d", depth, v.depth)
+		}
+		v.leaves = append(v.leaves, n.page.Offset())
+		var right uint64
+		if n.right != nil {
+			right = n.right.Offset()
+		}
+		v.rights = append(v.rights, right)
+		return uint64(len(n.keys))
+
+	case *interiorNode:
+		v.keys(n, n.keys, lo, hi)
+		if len(n.children) != len(n.keys)+1 || len(n.pages) != len(n.children) {
+			v.report(n, "%d keys but %d children", len(n.keys), len(n.children))
+			return 0
+		}
+		if len(n.keys) == 0 {
+			v.report(n, "interior node has no keys")
+		}
+		if !v.tree.interiorFits(n.keys) {
+			v.report(n, "interior node is over capacity")
+		}
+		if !isRoot && !rightEdge && n.underflows() {
+			v.report(n, "interior node is under capacity")
+		}
+		var rows uint64
+		for x := range n.children {
+			child := n.child(x)
+			if child.Page().Offset() != n.pages[x].Offset() {
+				v.report(n, "child %d is on page %d but the pointer is to %d", x, storage.PageNumber(child.Page().Offset()), storage.PageNumber(n.pages[x].Offset()))
+			}
+			l, h := lo, hi
+			if x > 0 {
+				l = n.keys[x-1]
+			}
+			if x < len(n.keys) {
+				h = n.keys[x]
+			}
+			count := v.node(child, l, h, depth+1, rightEdge && x == len(n.keys))
+			if v.tree.counted && n.counts[x] != count {
+				v.report(n, "child %d has %d keys but the count is %d", x, count, n.counts[x])
+			}
+			rows += count
+		}
+		return rows
+	}
+	return 0
+}
+
+//keys checks the keys are sorted and within lo <= key < hi
+func (v *verifier) keys(n noder, keys [][]byte, lo []byte, hi []byte) {
+	t := v.tree
+	for x, k := range keys {
+		if x > 0 && t.compare(keys[x-1], k) >= 0 {
+			v.report(n, "key %d %q isn't larger than the one before it %q", x, k, keys[x-1])
+		}
+		if lo != nil && t.compare(k, lo) < 0 {
+			v.report(n, "key %d %q is smaller than the separator before it %q", x, k, lo)
+		}
+		if hi != nil && t.compare(k, hi) >= 0 {
+			v.report(n, "key %d %q isn't smaller than the separator after it %q", x, k, hi)
+		}
+	}
+}
+
+//siblings checks the right pointers chain the leaves together in order.
+//Copy-on-write trees don't keep them.
+func (v *verifier) siblings() {
+	if !v.tree.siblingPointers() {
+		return
+	}
+	for x, right := range v.rights {
+		var next uint64
+		if x+1 < len(v.leaves) {
+			next = v.leaves[x+1]
+		}
+		if right != next {
+			v.errs = append(v.errs, fmt.Errorf("btree: page %d: right pointer is to page %s, the next leaf is %s", storage.PageNumber(v.leaves[x]), pageName(right), pageName(next)))
+		}
+	}
+}
+
+//pageName is the page number at offset for an error message, or none for 0
+func pageName(offset uint64) string {
+	if offset == 0 {
+		return "none"
+	}
+	return strconv.Itoa(storage.PageNumber(offset))
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"github.com/MattParker89/seaquell/machine"
 	"github.com/MattParker89/seaquell/parse"
+	"github.com/MattParker89/seaquell/storage"
+	"github.com/MattParker89/seaquell/vm"
 	"os"
 	"os/signal"
 	"syscall"
@@ -23,7 +25,11 @@ func main() {
 		}
 	}(text)
 
-	m := machine.New("test.db")
+	m, err := machine.New("test.db", storage.MODE_CREATE)
+	if err != nil {
+		fmt.Println("error opening db ", err)
+		return
+	}
 	defer m.Close()
 
 	fmt.Print(">")
@@ -35,6 +41,11 @@ func main() {
 		case t := <-text:
 			rom := parse.Generate(t)
 			res := m.Exec(rom)
+			if len(res) > 0 && res[0].ResultCode == vm.RESULT_ERROR {
+				fmt.Println("error:", res[0].Data[0])
+				fmt.Print(">")
+				continue
+			}
 			if len(res) > 0 {
 				r := res[0]
 				for _, col := range r.Columns {
@@ -16,26 +16,29 @@ type Machine struct {
 	rom    *vm.ROM
 	master *table
 	store  storage.Storer
+	temps  []storage.Storer //scratch storage for the running statement
 }
 
-func New(filename string) *Machine {
+func New(filename string, mode storage.Mode) (*Machine, error) {
 	m := &Machine{
 		stack: new(stack),
 	}
-	m.open(filename)
-	return m
+	if err := m.open(filename, mode); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
 func (m *Machine) Close() {
 	m.store.Close()
 }
 
-func (v *Machine) open(filename string) {
-	var err error
-	v.store, err = storage.Open(filename)
+func (v *Machine) open(filename string, mode storage.Mode) error {
+	s, err := storage.Open(filename, mode)
 	if err != nil {
-		v.store, _ = storage.Create(filename)
+		return err
 	}
+	v.store = s
 	tree := btree.Fetch(0)
 	v.master = &table{
 		key:     0,
@@ -44,6 +47,7 @@ func (v *Machine) open(filename string) {
 		columns: parseSchema("CREATE TABLE master(name text, page int, sql text);"),
 		tree:    tree,
 	}
+	return nil
 }
 
 func (v *Machine) Exec(rom *vm.ROM) []vm.ResultRow {
@@ -62,11 +66,17 @@ func gatherResults(result chan vm.ResultRow) (results []vm.ResultRow) {
 }
 
 func (v *Machine) run(result chan vm.ResultRow) {
+	//programs that run off the end without OP_HALT are cleaned up too
+	defer v.halt(result)
 	var currentTable *table
 	rowResult := vm.ResultRow{}
 Loop:
 	for i := 0; i < len(v.rom.Frames); i++ {
 		frame := v.rom.Frames[i]
+		if writesFile(frame.Op, currentTable) && v.store.ReadOnly() {
+			result <- errorRow(storage.ErrReadOnly)
+			break Loop
+		}
 		switch frame.Op {
 		case vm.OP_LOAD_R1, vm.OP_LOAD_R2, vm.OP_LOAD_R3:
 			var register *int64
@@ -91,6 +101,8 @@ Loop:
 			currentTable = openRead(v.master, frame.Value.(int64))
 		case vm.OP_OPEN_WRITE:
 			currentTable = openWrite(v.master, frame.Value.(int64))
+		case vm.OP_OPEN_EPHEMERAL:
+			currentTable = v.openEphemeral(frame.Value.(string))
 		case vm.OP_NEW_ROW_ID:
 			v.R3 = newRowID(currentTable)
 		case vm.OP_STRING:
@@ -108,11 +120,13 @@ Loop:
 		case vm.OP_WRITE_ROW:
 			value := v.stack.Pop()
 			key := v.stack.Pop()
-			currentTable.tree.Insert(int(key.(int64)), value.([]byte))
+			if err := currentTable.tree.Insert(int(key.(int64)), value.([]byte)); err != nil {
+				result <- errorRow(err)
+				break Loop
+			}
 		case vm.OP_CLOSE:
 			currentTable = nil
 		case vm.OP_HALT:
-			close(result)
 			break Loop
 		case vm.OP_COLUMN:
 			b := currentTable.tree.CursorData()
@@ -130,21 +144,59 @@ Loop:
 			rowResult.Columns = append(rowResult.Columns, currentTable.columns[column].name)
 		case vm.OP_RESULT_ROW:
 			result <- rowResult
-		case vm.OP_NEXT:
+		case vm.OP_LAST:
+			currentTable.tree.CursorLast()
+			//an empty table skips the loop, Preprocess points Value past its OP_PREV
+			if !currentTable.tree.CursorAvailable() {
+				i = int(frame.Value.(int64)) - 1
+			}
+		case vm.OP_NEXT, vm.OP_PREV:
 			rowResult = vm.ResultRow{}
-			currentTable.tree.CursorNext()
+			if frame.Op == vm.OP_NEXT {
+				currentTable.tree.CursorNext()
+			} else {
+				currentTable.tree.CursorPrev()
+			}
 			if currentTable.tree.CursorAvailable() {
 				i = int(frame.Value.(int64)) - 1
 			}
 		case vm.OP_CREATE_TABLE:
 			pageNumber := int(v.store.GetFreePage())
 			page := storage.GetPageNumber(pageNumber)
-			page.WriteLeaf([]uint64{}, [][]byte{}, nil)
+			page.WriteLeaf([][]byte{}, [][]byte{}, nil)
 			v.R3 = int64(pageNumber)
 		}
 	}
 }
 
+//halt throws away the statement's scratch storage and ends the results.
+//It runs once, when run returns.
+func (v *Machine) halt(result chan vm.ResultRow) {
+	for _, s := range v.temps {
+		s.Close()
+	}
+	v.temps = nil
+	close(result)
+}
+
+//writesFile reports whether the op modifies the database file
+func writesFile(op vm.OpCode, current *table) bool {
+	switch op {
+	case vm.OP_OPEN_WRITE, vm.OP_CREATE_TABLE:
+		return true
+	case vm.OP_WRITE_ROW:
+		return current == nil || !current.temp
+	}
+	return false
+}
+
+func errorRow(err error) vm.ResultRow {
+	return vm.ResultRow{
+		Data:       []interface{}{err},
+		ResultCode: vm.RESULT_ERROR,
+	}
+}
+
 func (m *Machine) findTableByName(name string) *table {
 	if name == "master" {
 		return m.master
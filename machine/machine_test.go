@@ -0,0 +1,111 @@
+package machine
+
+import (
+	"github.com/MattParker89/seaquell/storage"
+	"github.com/MattParker89/seaquell/vm"
+	"path/filepath"
+	"testing"
+)
+
+func newTestMachine(t *testing.T) *Machine {
+	m, err := New(filepath.Join(t.TempDir(), "test.db"), storage.MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	return m
+}
+
+func rom(ops ...vm.Frame) *vm.ROM {
+	r := vm.NewROM()
+	for _, f := range ops {
+		r.Add(f)
+	}
+	return r
+}
+
+func op(code vm.OpCode, value interface{}) vm.Frame {
+	return vm.Frame{Op: code, Value: value}
+}
+
+func Test_Temps_Closed_Without_Halt(t *testing.T) {
+	m := newTestMachine(t)
+	//no OP_HALT, the program just runs out of frames
+	m.Exec(rom(op(vm.OP_OPEN_EPHEMERAL, "CREATE TABLE t(a int);")))
+	if len(m.temps) != 0 {
+		t.Errorf("Expected the scratch storage to be closed; %d still open", len(m.temps))
+	}
+}
+
+//reverse is a program that returns the rows of a scratch table last to first
+func reverse(keys ...int64) *vm.ROM {
+	ops := []vm.Frame{op(vm.OP_OPEN_EPHEMERAL, "CREATE TABLE t(a int);")}
+	for _, k := range keys {
+		ops = append(ops,
+			op(vm.OP_INTEGER, k), op(vm.OP_PUSH_R3, nil),
+			op(vm.OP_INTEGER, k), op(vm.OP_PUSH_R3, nil),
+			op(vm.OP_MAKE_RECORD, int64(1)),
+			op(vm.OP_WRITE_ROW, nil))
+	}
+	ops = append(ops,
+		op(vm.OP_LAST, nil),
+		op(vm.OP_COLUMN, 0),
+		op(vm.OP_RESULT_ROW, nil),
+		op(vm.OP_PREV, nil),
+		op(vm.OP_HALT, nil))
+	return rom(ops...)
+}
+
+func Test_Last_Empty_Table(t *testing.T) {
+	m := newTestMachine(t)
+	if rows := m.Exec(reverse()); len(rows) != 0 {
+		t.Errorf("Expected no rows from an empty table; got %v", rows)
+	}
+
+	rows := m.Exec(reverse(1, 2, 3))
+	if len(rows) != 3 {
+		t.Fatalf("Expected 3 rows; got %v", rows)
+	}
+	for x, want := range []int64{3, 2, 1} {
+		if got := rows[x].Data[0]; got != want {
+			t.Errorf("Expected row %d to be %d; got %v", x, want, got)
+		}
+	}
+}
+
+func Test_Read_Only_Rejects_Writes(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	m, err := New(name, storage.MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	m, err = New(name, storage.MODE_READ_ONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	programs := map[string]*vm.ROM{
+		"OP_CREATE_TABLE": rom(op(vm.OP_CREATE_TABLE, nil), op(vm.OP_HALT, nil)),
+		"OP_OPEN_WRITE":   rom(op(vm.OP_OPEN_WRITE, int64(0)), op(vm.OP_HALT, nil)),
+		"OP_WRITE_ROW": rom(
+			op(vm.OP_OPEN_READ, int64(0)),
+			op(vm.OP_INTEGER, int64(1)), op(vm.OP_PUSH_R3, nil),
+			op(vm.OP_INTEGER, int64(1)), op(vm.OP_PUSH_R3, nil),
+			op(vm.OP_MAKE_RECORD, int64(1)),
+			op(vm.OP_WRITE_ROW, nil),
+			op(vm.OP_HALT, nil)),
+	}
+	for name, program := range programs {
+		rows := m.Exec(program)
+		if len(rows) != 1 || rows[0].ResultCode != vm.RESULT_ERROR || rows[0].Data[0] != storage.ErrReadOnly {
+			t.Errorf("%s: Expected an ErrReadOnly row; got %v", name, rows)
+		}
+	}
+
+	//scratch tables aren't in the file so they can still be written
+	if rows := m.Exec(reverse(1, 2)); len(rows) != 2 {
+		t.Errorf("Expected 2 rows from a scratch table; got %v", rows)
+	}
+}
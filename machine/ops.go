@@ -3,6 +3,7 @@ package machine
 import (
 	"encoding/binary"
 	"github.com/MattParker89/seaquell/btree"
+	"github.com/MattParker89/seaquell/storage"
 	"math"
 	"strings"
 )
@@ -113,6 +114,19 @@ func open(master *table, tableID int64) *table {
 	return t
 }
 
+//openEphemeral creates an empty table in scratch storage.
+//The storage is closed when the statement halts.
+func (v *Machine) openEphemeral(sql string) *table {
+	s := storage.CreateTemp()
+	v.temps = append(v.temps, s)
+	return &table{
+		name:    "ephemeral",
+		columns: parseSchema(sql),
+		tree:    btree.NewIn(s),
+		temp:    true,
+	}
+}
+
 func newRowID(t *table) int64 {
 	return int64(t.tree.LastKey() + 1)
 }
@@ -21,7 +21,7 @@ func (v *Machine) Preprocess(rom *vm.ROM) (*vm.ROM, error) {
 				frame.Value = currentTable.key
 				rom.Frames[i] = frame
 			}
-		case vm.OP_REWIND:
+		case vm.OP_REWIND, vm.OP_LAST:
 			rewindLocations = append(rewindLocations, i)
 		case vm.OP_COLUMN:
 			switch val := frame.Value.(type) {
@@ -30,7 +30,7 @@ func (v *Machine) Preprocess(rom *vm.ROM) (*vm.ROM, error) {
 				frame.Value = column.index
 				rom.Frames[i] = frame
 			}
-		case vm.OP_NEXT:
+		case vm.OP_NEXT, vm.OP_PREV:
 			nextLocations = append(nextLocations, i)
 		}
 	}
@@ -10,6 +10,7 @@ type table struct {
 	page    int64
 	columns []*column
 	tree    *btree.BTree
+	temp    bool //lives in scratch storage instead of the database file
 }
 
 func (t *table) getColumnByName(name string) *column {
@@ -21,20 +22,27 @@ func (t *table) getColumnByName(name string) *column {
 	return nil
 }
 
+//findRecordWithID and findRecordsByFieldValue use their own cursors
+//so they don't disturb a scan that is running on the same table
 func (t *table) findRecordWithID(id int64) map[string]interface{} {
-	b := t.tree.Get(int(id))
-	m := t.recordFromBytes(b)
-	m["key"] = int64(t.tree.CursorKey())
+	c := t.tree.NewCursor()
+	c.Seek(int(id))
+	if !c.Available() || c.Key() != uint64(id) {
+		return nil
+	}
+	m := t.recordFromBytes(c.Data())
+	m["key"] = id
 	return m
 
 }
 
 func (t *table) findRecordsByFieldValue(field string, value interface{}) []map[string]interface{} {
 	records := []map[string]interface{}{}
-	for t.tree.CursorFront(); t.tree.CursorAvailable(); t.tree.CursorNext() {
-		data := t.tree.CursorData()
+	c := t.tree.NewCursor()
+	for c.First(); c.Available(); c.Next() {
+		data := c.Data()
 		record := t.recordFromBytes(data)
-		record["key"] = int64(t.tree.CursorKey())
+		record["key"] = int64(c.Key())
 		if record[field] == value {
 			records = append(records, record)
 		}
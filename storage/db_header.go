@@ -14,14 +14,33 @@ const (
 	page_size_length     = 2
 	free_page_offset     = 36
 	free_page_size       = 4
+	free_list_offset     = 40 //offset of the first page on the free list
+	free_list_size       = 8
+	free_count_offset    = 48 //number of pages on the free list
+	free_count_size      = 4
+	format_offset        = 52 //version of the page layout the file was written with
+	format_size          = 2
 )
 
+/*
+Format version:
+Whenever the way pages are laid out changes the version goes up, Open
+refuses files written with another one instead of misreading them.
+Files from before there was a version have 0 there.
+
+1 keys are length prefixed byte strings in BigEndian order
+2 pages keep the prefix their keys share once, in the page header
+3 the page header has flags, interior pages can have counts
+*/
+const format_version = 3
+
 type dbHeader [db_header_length]byte
 
 func writeHeader() dbHeader {
 	var h dbHeader
 	copy(h[header_string_offset:header_string_offset+header_string_size], header_string)
 	binary.LittleEndian.PutUint16(h[page_size_offset:page_size_offset+page_size_length], uint16(page_length))
+	binary.LittleEndian.PutUint16(h[format_offset:format_offset+format_size], format_version)
 
 	//kick off the first free page after the header
 	binary.LittleEndian.PutUint32(h[free_page_offset:free_page_offset+free_page_size], uint32(db_header_length))
@@ -10,21 +10,34 @@ Basics of a page:
 - The header will tell us where the cell pointer array (CPA) is
 - CPA tells us where each cell is
 
-Leaf:
-- The first 2 bytes tell you the key
-- The remaining bytes have the following format:
-	- 2 bytes = length of the following value
-	- The value
-Interior:
-- 8 bytes pointer
-- 2 bytes key
+Keys are byte strings. Nothing in here knows how they are ordered,
+that's up to the btree.
+
+Leaf cell:
+- 2 bytes = length of the key
+- The key
+- 2 bytes = length of the value
+- The value
+Interior cell:
+- 2 bytes = length of the key
+- The key
+- 8 bytes = pointer to the child left of the key
+- 8 bytes = rows under that child, only if the page keeps counts
+There is one more child than keys. The cell pointer after the last key
+points at the last child's 8 byte pointer on its own.
+
+Keys on a page often start the same way, sorted keys more so. The prefix
+all of a page's keys share is written once at the very end of the page,
+its length is in the header, and the cells only hold what comes after it.
 */
 
 type Pager interface {
-	WriteLeaf(keys []uint64, values [][]byte, rightPtr Pager)
-	WriteInterior(keys []uint64, children []Pager)
-	FetchInterior() ([]uint64, []Pager)
-	FetchLeaf() ([]uint64, [][]byte, Pager)
+	WriteLeaf(keys [][]byte, values [][]byte, rightPtr Pager)
+	WriteInterior(keys [][]byte, children []Pager, counts []uint64) //nil counts aren't stored
+	FetchInterior() ([][]byte, []Pager, []uint64)                   //counts are nil if the page has none
+	FetchLeaf() ([][]byte, [][]byte, Pager)
+	Create() Pager          //allocates a new page in the same storage
+	At(offset uint64) Pager //the page at offset in the same storage
 	Free()
 	Offset() uint64
 	Type() NodeType
@@ -43,14 +56,70 @@ const (
 )
 
 const (
-	key_length = 8
+	length_size  = 2 //bytes used for the length of a key or value
+	pointer_size = 8
+
+	//COUNT_SIZE is what an interior page that keeps counts spends on each child's count
+	COUNT_SIZE = 8
+
+	//PAGE_CAPACITY is the number of bytes available for cells and cell pointers
+	PAGE_CAPACITY = page_length - page_header_length - 1
 )
 
+//LeafCellSize returns the bytes a leaf cell takes up, including its cell pointer
+func LeafCellSize(key []byte, value []byte) int {
+	return length_size + len(key) + length_size + len(value) + 2
+}
+
+//InteriorCellSize returns the bytes a key and the child pointer to its left take up,
+//including the cell pointer
+func InteriorCellSize(key []byte) int {
+	return length_size + len(key) + pointer_size + 2
+}
+
+//LeafSize returns the bytes the cells of a leaf and their shared prefix take up
+func LeafSize(keys [][]byte, values [][]byte) int {
+	prefix := len(CommonPrefix(keys))
+	size := prefix
+	for i, k := range keys {
+		size += LeafCellSize(k[prefix:], values[i])
+	}
+	return size
+}
+
+//InteriorSize returns the bytes the cells of an interior page and their shared prefix take up.
+//There is one more child than keys.
+func InteriorSize(keys [][]byte) int {
+	prefix := len(CommonPrefix(keys))
+	size := prefix + pointer_size + 2
+	for _, k := range keys {
+		size += InteriorCellSize(k[prefix:])
+	}
+	return size
+}
+
+//CommonPrefix returns the longest prefix all the keys start with
+func CommonPrefix(keys [][]byte) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	prefix := keys[0]
+	for _, k := range keys[1:] {
+		n := 0
+		for n < len(prefix) && n < len(k) && prefix[n] == k[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
 type page struct {
 	buffer       [page_length]byte
 	offset       uint64
 	header       *pageHeader
 	cellPointers []byte
+	store        Storer //nil means the package level store
 }
 
 func NewPage() *page {
@@ -60,8 +129,41 @@ func NewPage() *page {
 	}
 }
 
-func (p *page) WriteLeaf(keys []uint64, values [][]byte, rightPtr Pager) {
+//NewPageIn allocates a page in s instead of the main database file
+func NewPageIn(s Storer) *page {
+	return &page{
+		header: NewPageHeader(),
+		offset: s.GetFreePage()*page_length + db_header_length + 1,
+		store:  s,
+	}
+}
+
+func (p *page) Create() Pager {
+	if p.store == nil {
+		return NewPage()
+	}
+	return NewPageIn(p.store)
+}
+
+//At returns the page at offset in the same storage as p
+func (p *page) At(offset uint64) Pager {
+	return &page{
+		offset: offset,
+		header: NewPageHeader(),
+		store:  p.store,
+	}
+}
+
+func (p *page) storer() Storer {
+	if p.store == nil {
+		return store
+	}
+	return p.store
+}
+
+func (p *page) WriteLeaf(keys [][]byte, values [][]byte, rightPtr Pager) {
 	p.header.nodeType = LEAF_NODE
+	p.header.flags = 0
 	p.buffer = [page_length]byte{}
 
 	//start writing from the back of the page and move inwards
@@ -70,38 +172,36 @@ func (p *page) WriteLeaf(keys []uint64, values [][]byte, rightPtr Pager) {
 	//make sure we're starting with a blank page
 	cellPointer := p.header.cellPointerArray
 	p.header.numberOfCells = 0
+	prefix := p.pushPrefix(keys)
 
 	//we loop through the keys because with a leaf node there is a 1 to 1 match on keys to values
 	for i, k := range keys {
-		//write the payload
-		val := values[i]
-		copy(p.buffer[p.header.cellContentArea-uint16(len(val)):p.header.cellContentArea], val)
-		p.header.cellContentArea -= uint16(len(val))
-
-		//write the length of the payload so we know where the cell ends
-		valueLength := uint16(len(val))
-		binary.LittleEndian.PutUint16(p.buffer[p.header.cellContentArea-2:p.header.cellContentArea], valueLength)
-		p.header.cellContentArea -= 2
+		//write the payload and its length so we know where the cell ends
+		p.pushBytes(values[i])
 
-		//write the key
-		binary.LittleEndian.PutUint64(p.buffer[p.header.cellContentArea-8:p.header.cellContentArea], k)
-		p.header.cellContentArea -= 8
+		//write what is left of the key and its length
+		p.pushBytes(k[prefix:])
 
 		//add a pointer to the cell pointer array
 		binary.LittleEndian.PutUint16(p.buffer[cellPointer:cellPointer+2], uint16(p.header.cellContentArea))
 		cellPointer += 2
 		p.header.numberOfCells += 1
 	}
+	p.header.rightMostPointer = 0
 	if rightPtr != nil {
 		p.header.rightMostPointer = rightPtr.Offset()
 	}
 	p.writeHeader()
-	store.writeHeader()
-	store.WritePage(p)
+	p.storer().writeHeader()
+	p.storer().WritePage(p)
 }
 
-func (p *page) WriteInterior(keys []uint64, children []Pager) {
+func (p *page) WriteInterior(keys [][]byte, children []Pager, counts []uint64) {
 	p.header.nodeType = INTERIOR_NODE
+	p.header.flags = 0
+	if counts != nil {
+		p.header.flags = flag_counts
+	}
 
 	//clearing the buffer because I had a weird bug
 	//due to it being used multiple times when a node gets promoted
@@ -113,21 +213,26 @@ func (p *page) WriteInterior(keys []uint64, children []Pager) {
 	//make sure we're starting with a blank page
 	cellPointer := p.header.cellPointerArray
 	p.header.numberOfCells = 0
+	prefix := p.pushPrefix(keys)
 
 	//we loop over the children because the format for an interior node is
 	//child -> key -> child
 	//so there are more children than keys
 	for i, c := range children {
+		//the count goes after the pointer
+		if counts != nil {
+			binary.LittleEndian.PutUint64(p.buffer[p.header.cellContentArea-COUNT_SIZE:p.header.cellContentArea], counts[i])
+			p.header.cellContentArea -= COUNT_SIZE
+		}
+
 		//write the pointer to the child's page
-		binary.LittleEndian.PutUint64(p.buffer[p.header.cellContentArea-8:p.header.cellContentArea], c.Offset())
-		p.header.cellContentArea -= 8
+		binary.LittleEndian.PutUint64(p.buffer[p.header.cellContentArea-pointer_size:p.header.cellContentArea], c.Offset())
+		p.header.cellContentArea -= pointer_size
 
 		//there are more children than keys
 		//so we need to make sure we don't go over
 		if i < len(keys) {
-			//write the key
-			binary.LittleEndian.PutUint64(p.buffer[p.header.cellContentArea-8:p.header.cellContentArea], keys[i])
-			p.header.cellContentArea -= 8
+			p.pushBytes(keys[i][prefix:])
 
 			//totally arbitrary. We can choose to keep track
 			//of the keys or the pointers
@@ -140,50 +245,91 @@ func (p *page) WriteInterior(keys []uint64, children []Pager) {
 		cellPointer += 2
 	}
 	p.writeHeader()
-	store.writeHeader()
-	store.WritePage(p)
+	p.storer().writeHeader()
+	p.storer().WritePage(p)
+}
+
+//pushBytes writes b and then its length in front of the cell content area
+func (p *page) pushBytes(b []byte) {
+	copy(p.buffer[p.header.cellContentArea-uint16(len(b)):p.header.cellContentArea], b)
+	p.header.cellContentArea -= uint16(len(b))
+	binary.LittleEndian.PutUint16(p.buffer[p.header.cellContentArea-length_size:p.header.cellContentArea], uint16(len(b)))
+	p.header.cellContentArea -= length_size
+}
+
+//pushPrefix writes the prefix the keys share at the back of the page and returns its length
+func (p *page) pushPrefix(keys [][]byte) int {
+	prefix := CommonPrefix(keys)
+	copy(p.buffer[p.header.cellContentArea-uint16(len(prefix)):p.header.cellContentArea], prefix)
+	p.header.cellContentArea -= uint16(len(prefix))
+	p.header.keyPrefix = uint16(len(prefix))
+	return len(prefix)
+}
+
+//readKey reads a key from a cell and puts the page's prefix back in front of it
+func (p *page) readKey(offset uint16) ([]byte, uint16) {
+	length := binary.LittleEndian.Uint16(p.buffer[offset : offset+length_size])
+	offset += length_size
+	key := make([]byte, int(p.header.keyPrefix)+int(length))
+	copy(key, p.buffer[page_length-int(p.header.keyPrefix):])
+	copy(key[p.header.keyPrefix:], p.buffer[offset:offset+length])
+	return key, offset + length
+}
+
+//readBytes reads a length and the bytes after it. It returns a copy of the bytes
+//and the offset right after them.
+func (p *page) readBytes(offset uint16) ([]byte, uint16) {
+	length := binary.LittleEndian.Uint16(p.buffer[offset : offset+length_size])
+	offset += length_size
+
+	/*
+		We need to make a copy of the byte array. If not then the values in the btree get tied to the page's buffer because their pointers are the same. If you clear the buffer, you clear the btree node's values.
+	*/
+	b := make([]byte, length)
+	copy(b, p.buffer[offset:offset+length])
+	return b, offset + length
 }
 
-func (p *page) FetchInterior() ([]uint64, []Pager) {
+//cellOffset looks up the ith entry in the cell pointer array
+func (p *page) cellOffset(i int) uint16 {
+	pointer := int(p.header.cellPointerArray) + i*2
+	return binary.LittleEndian.Uint16(p.buffer[pointer : pointer+2])
+}
+
+func (p *page) FetchInterior() ([][]byte, []Pager, []uint64) {
 	if !p.isFetched() {
 		p.fetch()
 	}
 	p.parseHeader()
 
-	keys := []uint64{}
+	keys := [][]byte{}
 	pages := []Pager{}
+	var counts []uint64
+	if p.header.cellPointerArray == 0 || p.header.nodeType != INTERIOR_NODE {
+		return keys, pages, counts
+	}
 
-	for i := 0; i < int(p.header.numberOfCells); i++ {
-		pointerBytes := p.cellPointers[i*2 : (i*2)+2]
-		cellOffset := binary.LittleEndian.Uint16(pointerBytes)
-
-		keyBytes := p.buffer[cellOffset : cellOffset+8]
-		key := binary.LittleEndian.Uint64(keyBytes)
+	//the last cell pointer is the child with no key
+	for i := 0; i <= int(p.header.numberOfCells); i++ {
+		offset := p.cellOffset(i)
+		if i < int(p.header.numberOfCells) {
+			var key []byte
+			key, offset = p.readKey(offset)
+			keys = append(keys, key)
+		}
 
-		childPointerBytes := p.buffer[cellOffset+8 : cellOffset+8+8]
-		childPointer := binary.LittleEndian.Uint64(childPointerBytes)
-		childPage := &page{
+		childPointer := binary.LittleEndian.Uint64(p.buffer[offset : offset+pointer_size])
+		pages = append(pages, &page{
 			offset: childPointer,
 			header: NewPageHeader(),
-		}
-
-		keys = append(keys, uint64(key))
-		pages = append(pages, childPage)
-
-		if i+1 == int(p.header.numberOfCells) {
-			childPointerBytes = p.buffer[cellOffset-8 : cellOffset]
-			childPointer = binary.LittleEndian.Uint64(childPointerBytes)
-			childPage = &page{
-				offset: childPointer,
-				header: NewPageHeader(),
-			}
-
-			pages = append(pages, childPage)
-
+			store:  p.store,
+		})
+		if p.header.flags&flag_counts != 0 {
+			counts = append(counts, binary.LittleEndian.Uint64(p.buffer[offset+pointer_size:offset+pointer_size+COUNT_SIZE]))
 		}
 	}
 
-	return keys, pages
+	return keys, pages, counts
 
 }
 func (p *page) NumberOfKeys() uint16 {
@@ -194,9 +340,9 @@ func (p *page) NumberOfKeys() uint16 {
 	return p.header.numberOfCells
 }
 func (p *page) fetch() {
-	copy(p.buffer[:], store.Get(p.offset, page_length))
+	copy(p.buffer[:], p.storer().Get(p.offset, page_length))
 }
-func (p *page) FetchLeaf() (keys []uint64, values [][]byte, rightPtr Pager) {
+func (p *page) FetchLeaf() (keys [][]byte, values [][]byte, rightPtr Pager) {
 	if !p.isFetched() {
 		p.fetch()
 	}
@@ -204,28 +350,14 @@ func (p *page) FetchLeaf() (keys []uint64, values [][]byte, rightPtr Pager) {
 
 	for i := 0; i < int(p.header.numberOfCells); i++ {
 		//go through the cell pointer array and find the offset
-		pointerBytes := p.cellPointers[i*2 : (i*2)+2]
-		cellOffset := binary.LittleEndian.Uint16(pointerBytes)
-
-		//we have the offset. Let's first read the key
-		keyBytes := p.buffer[cellOffset : cellOffset+8]
-		key := binary.LittleEndian.Uint64(keyBytes)
-
-		//Now let's read the length of the body
-		cellLengthBytes := p.buffer[cellOffset+8 : cellOffset+8+2]
-		cellLength := binary.LittleEndian.Uint16(cellLengthBytes)
+		offset := p.cellOffset(i)
 
-		//Get the payload
-		val := p.buffer[cellOffset+8+2 : cellOffset+8+2+cellLength]
+		//we have the offset. Let's first read the key and then the payload
+		key, offset := p.readKey(offset)
+		val, _ := p.readBytes(offset)
 
-		/*
-			We need to make a copy of the byte array. If not then the values in the btree get tied to the page's buffer because their pointers are the same. If you clear the buffer, you clear the btree node's values.
-		*/
-		v := make([]byte, len(val))
-		copy(v, val)
-
-		keys = append(keys, uint64(key))
-		values = append(values, v)
+		keys = append(keys, key)
+		values = append(values, val)
 	}
 
 	var rightPage Pager = nil
@@ -233,6 +365,7 @@ func (p *page) FetchLeaf() (keys []uint64, values [][]byte, rightPtr Pager) {
 		rightPage = &page{
 			offset: p.header.rightMostPointer,
 			header: NewPageHeader(),
+			store:  p.store,
 		}
 	}
 
@@ -252,6 +385,9 @@ func (p *page) parseHeader() {
 
 	rightPtrBytes := p.buffer[btreePageHeaderConfig[right_most_pointer].offset : btreePageHeaderConfig[right_most_pointer].offset+btreePageHeaderConfig[right_most_pointer].size]
 	p.header.rightMostPointer = binary.LittleEndian.Uint64(rightPtrBytes)
+	prefixBytes := p.buffer[btreePageHeaderConfig[key_prefix].offset : btreePageHeaderConfig[key_prefix].offset+btreePageHeaderConfig[key_prefix].size]
+	p.header.keyPrefix = binary.LittleEndian.Uint16(prefixBytes)
+	p.header.flags = p.buffer[btreePageHeaderConfig[flags].offset]
 	p.cellPointers = p.buffer[p.header.cellPointerArray : p.header.cellPointerArray+p.header.numberOfCells*2]
 
 	nodeTypeBytes := p.buffer[btreePageHeaderConfig[node_type].offset]
@@ -262,12 +398,18 @@ func (p *page) writeHeader() {
 	binary.LittleEndian.PutUint16(p.buffer[btreePageHeaderConfig[cell_pointer_array].offset:btreePageHeaderConfig[cell_pointer_array].offset+btreePageHeaderConfig[cell_pointer_array].size], p.header.cellPointerArray)
 	binary.LittleEndian.PutUint16(p.buffer[btreePageHeaderConfig[number_of_cells].offset:btreePageHeaderConfig[number_of_cells].offset+btreePageHeaderConfig[number_of_cells].size], p.header.numberOfCells)
 	binary.LittleEndian.PutUint64(p.buffer[btreePageHeaderConfig[right_most_pointer].offset:btreePageHeaderConfig[right_most_pointer].offset+btreePageHeaderConfig[right_most_pointer].size], p.header.rightMostPointer)
+	binary.LittleEndian.PutUint16(p.buffer[btreePageHeaderConfig[key_prefix].offset:btreePageHeaderConfig[key_prefix].offset+btreePageHeaderConfig[key_prefix].size], p.header.keyPrefix)
+	p.buffer[btreePageHeaderConfig[flags].offset] = p.header.flags
 	kb := p.header.nodeType.Byte()
 	p.buffer[btreePageHeaderConfig[node_type].offset] = kb
 }
 
+//Free puts the page on the free list. The page must not be used afterwards.
 func (p *page) Free() {
-
+	p.storer().freePage(p.offset)
+	p.buffer = [page_length]byte{}
+	p.header = NewPageHeader()
+	p.cellPointers = nil
 }
 
 func (p *page) Type() NodeType {
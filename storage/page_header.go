@@ -10,6 +10,8 @@ const (
 	cell_pointer_array
 	number_of_fragmented_bytes
 	right_most_pointer
+	key_prefix
+	flags
 )
 
 type btreeType int
@@ -20,9 +22,12 @@ const (
 )
 
 const (
-	page_header_length = 18
+	page_header_length = 21
 )
 
+//flag_counts is set on interior pages that store how many rows are under each child
+const flag_counts = 1
+
 type headerData struct {
 	offset int
 	size   int
@@ -36,6 +41,8 @@ var btreePageHeaderConfig = map[btreePageHeaderSection]*headerData{
 	cell_pointer_array:         &headerData{7, 2},
 	number_of_fragmented_bytes: &headerData{9, 1},
 	right_most_pointer:         &headerData{10, 8},
+	key_prefix:                 &headerData{18, 2},
+	flags:                      &headerData{20, 1},
 }
 
 type pageHeader struct {
@@ -48,6 +55,8 @@ type pageHeader struct {
 	numberOfFragmentedFreeBytes uint16
 	overflowPage                uint32
 	rightMostPointer            uint64
+	keyPrefix                   uint16 //length of the prefix every key on the page shares
+	flags                       uint8
 }
 
 func NewPageHeader() *pageHeader {
@@ -20,24 +20,33 @@ func (m *MockStorer) Get(offset uint64, length int) []byte {
 func (m *MockStorer) GetFreePage() uint64 {
 	return 0
 }
+func (m *MockStorer) ReadOnly() bool {
+	return false
+}
+func (m *MockStorer) writeHeader() {
+
+}
+func (m *MockStorer) freePage(offset uint64) {
+
+}
 
 func Test_Leaf(t *testing.T) {
 	store = &MockStorer{}
 	p := &page{header: NewPageHeader()}
 
-	keys := []uint64{0, 1, 2, 3}
+	keys := [][]byte{[]byte("a"), []byte("bb"), []byte(""), []byte("a longer key")}
 	values := [][]byte{[]byte{0}, []byte{1}, []byte{2}, []byte{3}}
-	p.WriteLeaf(keys, values, 0)
+	p.WriteLeaf(keys, values, nil)
 
 	//The key thing here is that we keep the same buffer.
 	newPage := &page{
 		header: NewPageHeader(),
 		buffer: p.buffer,
 	}
-	fetchedKeys, fetchedValues := newPage.FetchLeaf()
+	fetchedKeys, fetchedValues, _ := newPage.FetchLeaf()
 	for i, k := range keys {
-		if k != fetchedKeys[i] {
-			t.Errorf("Keys: Expected %d; got %d", k, fetchedKeys[i])
+		if !bytes.Equal(k, fetchedKeys[i]) {
+			t.Errorf("Keys: Expected %q; got %q", k, fetchedKeys[i])
 		}
 		if !bytes.Equal(values[i], fetchedValues[i]) {
 			t.Errorf("Values: Expected %v; got %v", values[i], fetchedValues[i])
@@ -51,19 +60,25 @@ func Test_Interior(t *testing.T) {
 		header: NewPageHeader(),
 	}
 
-	keys := []uint64{1}
-	children := []Pager{&page{offset: 10}, &page{offset: 20}}
-	mainPage.WriteInterior(keys, children)
+	keys := [][]byte{[]byte("m"), []byte("tuv")}
+	children := []Pager{&page{offset: 10}, &page{offset: 20}, &page{offset: 30}}
+	mainPage.WriteInterior(keys, children, nil)
 
 	//The key thing here is that we keep the same buffer.
 	newPage := &page{
 		header: NewPageHeader(),
 		buffer: mainPage.buffer,
 	}
-	fetchedKeys, fetchedChildren := newPage.FetchInterior()
+	fetchedKeys, fetchedChildren, fetchedCounts := newPage.FetchInterior()
+	if len(fetchedKeys) != len(keys) || len(fetchedChildren) != len(children) {
+		t.Fatalf("Expected %d keys and %d children; got %d and %d", len(keys), len(children), len(fetchedKeys), len(fetchedChildren))
+	}
+	if fetchedCounts != nil {
+		t.Errorf("Expected no counts; got %v", fetchedCounts)
+	}
 	for i, k := range keys {
-		if k != fetchedKeys[i] {
-			t.Errorf("Keys: Expected %d; got %d", k, fetchedKeys[i])
+		if !bytes.Equal(k, fetchedKeys[i]) {
+			t.Errorf("Keys: Expected %q; got %q", k, fetchedKeys[i])
 		}
 	}
 	for i, c := range children {
@@ -72,3 +87,94 @@ func Test_Interior(t *testing.T) {
 		}
 	}
 }
+
+func Test_Key_Prefix(t *testing.T) {
+	store = &MockStorer{}
+	p := &page{header: NewPageHeader()}
+
+	keys := [][]byte{[]byte("user:1"), []byte("user:10"), []byte("user:2"), []byte("user:")}
+	values := [][]byte{[]byte{0}, []byte{1}, []byte{2}, []byte{3}}
+	if prefix := CommonPrefix(keys); string(prefix) != "user:" {
+		t.Errorf("Expected the prefix %q; got %q", "user:", prefix)
+	}
+	uncompressed := 0
+	for i, k := range keys {
+		uncompressed += LeafCellSize(k, values[i])
+	}
+	if size := LeafSize(keys, values); size != uncompressed-3*len("user:") {
+		t.Errorf("Expected the prefix to be stored once, size %d; got %d", uncompressed-3*len("user:"), size)
+	}
+	p.WriteLeaf(keys, values, nil)
+
+	newPage := &page{
+		header: NewPageHeader(),
+		buffer: p.buffer,
+	}
+	fetchedKeys, fetchedValues, _ := newPage.FetchLeaf()
+	for i, k := range keys {
+		if !bytes.Equal(k, fetchedKeys[i]) {
+			t.Errorf("Keys: Expected %q; got %q", k, fetchedKeys[i])
+		}
+		if !bytes.Equal(values[i], fetchedValues[i]) {
+			t.Errorf("Values: Expected %v; got %v", values[i], fetchedValues[i])
+		}
+	}
+
+	children := []Pager{&page{offset: 10}, &page{offset: 20}, &page{offset: 30}}
+	p.WriteInterior(keys[:2], children, nil)
+	newPage = &page{
+		header: NewPageHeader(),
+		buffer: p.buffer,
+	}
+	fetchedKeys, fetchedChildren, _ := newPage.FetchInterior()
+	for i, k := range keys[:2] {
+		if !bytes.Equal(k, fetchedKeys[i]) {
+			t.Errorf("Keys: Expected %q; got %q", k, fetchedKeys[i])
+		}
+	}
+	if len(fetchedChildren) != len(children) {
+		t.Errorf("Expected %d children; got %d", len(children), len(fetchedChildren))
+	}
+}
+
+func Test_Interior_Counts(t *testing.T) {
+	store = &MockStorer{}
+	p := &page{header: NewPageHeader()}
+
+	keys := [][]byte{[]byte("row:1"), []byte("row:5")}
+	children := []Pager{&page{offset: 10}, &page{offset: 20}, &page{offset: 30}}
+	counts := []uint64{4, 1 << 40, 7}
+	p.WriteInterior(keys, children, counts)
+
+	newPage := &page{
+		header: NewPageHeader(),
+		buffer: p.buffer,
+	}
+	fetchedKeys, fetchedChildren, fetchedCounts := newPage.FetchInterior()
+	if len(fetchedCounts) != len(counts) {
+		t.Fatalf("Expected %d counts; got %v", len(counts), fetchedCounts)
+	}
+	for i, c := range counts {
+		if fetchedCounts[i] != c {
+			t.Errorf("Counts: Expected %d; got %d", c, fetchedCounts[i])
+		}
+		if fetchedChildren[i].Offset() != children[i].Offset() {
+			t.Errorf("Children: Expected %v; got %v", children[i].Offset(), fetchedChildren[i].Offset())
+		}
+	}
+	for i, k := range keys {
+		if !bytes.Equal(k, fetchedKeys[i]) {
+			t.Errorf("Keys: Expected %q; got %q", k, fetchedKeys[i])
+		}
+	}
+
+	//rewriting without counts clears the flag
+	p.WriteInterior(keys, children, nil)
+	newPage = &page{
+		header: NewPageHeader(),
+		buffer: p.buffer,
+	}
+	if _, _, fetchedCounts = newPage.FetchInterior(); fetchedCounts != nil {
+		t.Errorf("Expected no counts; got %v", fetchedCounts)
+	}
+}
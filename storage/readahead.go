@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+/*
+Readahead:
+Full table scans walk the leaves from left to right by following each leaf's
+right pointer. Every hop is a separate synchronous read, so a scan is bound by
+latency instead of bandwidth.
+
+Every page read goes through observe. Once we've seen readahead_trigger leaves
+in a row where each one was the right sibling of the one before, a background
+goroutine follows the chain and keeps up to readahead_window pages waiting in
+memory. Get hands those pages out (and forgets them) before going to disk.
+*/
+
+const (
+	readahead_trigger = 2
+	readahead_window  = 8
+)
+
+type readahead struct {
+	sync.Mutex
+	pages      map[uint64][]byte
+	next       uint64 //right sibling of the last leaf that was read
+	streak     int
+	generation uint64 //bumped on every write so in flight reads can't cache stale pages
+	running    bool
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+//take hands out a prefetched page. The page is forgotten afterwards.
+func (r *readahead) take(offset uint64) []byte {
+	r.Lock()
+	defer r.Unlock()
+	b, ok := r.pages[offset]
+	if !ok {
+		return nil
+	}
+	delete(r.pages, offset)
+	return b
+}
+
+//observe is called with every page read from disk or from the prefetched pages
+func (r *readahead) observe(s *storage, offset uint64, b []byte) {
+	right, ok := leafSibling(b)
+	if !ok {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if offset == r.next && r.streak > 0 {
+		r.streak++
+	} else {
+		//a new scan started somewhere else. Whatever we prefetched is useless.
+		r.streak = 1
+		r.pages = nil
+	}
+	r.next = right
+	if right == 0 || r.streak < readahead_trigger || r.running || r.closed {
+		return
+	}
+	r.running = true
+	r.wg.Add(1)
+	go r.prefetch(s, right)
+}
+
+func (r *readahead) prefetch(s *storage, offset uint64) {
+	defer r.wg.Done()
+	defer func() {
+		r.Lock()
+		r.running = false
+		r.Unlock()
+	}()
+
+	for i := 0; i < readahead_window && offset != 0; i++ {
+		r.Lock()
+		if r.closed || len(r.pages) >= readahead_window {
+			r.Unlock()
+			return
+		}
+		b, cached := r.pages[offset]
+		generation := r.generation
+		r.Unlock()
+
+		if !cached {
+			b = make([]byte, page_length)
+			if _, err := s.file.ReadAt(b, int64(offset)); err != nil {
+				return
+			}
+			r.Lock()
+			if r.generation != generation {
+				//the file changed under us, let the reader go to disk
+				r.Unlock()
+				return
+			}
+			if r.pages == nil {
+				r.pages = map[uint64][]byte{}
+			}
+			r.pages[offset] = b
+			r.Unlock()
+		}
+
+		var ok bool
+		offset, ok = leafSibling(b)
+		if !ok {
+			return
+		}
+	}
+}
+
+//invalidate drops a prefetched copy of a page that is being written.
+//It's called before and after the write, a prefetch that starts while the write
+//is going on can read the old bytes and the second call throws those away.
+func (r *readahead) invalidate(offset uint64) {
+	r.Lock()
+	defer r.Unlock()
+	r.generation++
+	delete(r.pages, offset)
+}
+
+func (r *readahead) close() {
+	r.Lock()
+	r.closed = true
+	r.Unlock()
+	r.wg.Wait()
+}
+
+//leafSibling returns the right pointer of a raw page if it is a leaf
+func leafSibling(b []byte) (uint64, bool) {
+	if len(b) != page_length {
+		return 0, false
+	}
+	cpa := btreePageHeaderConfig[cell_pointer_array]
+	if binary.LittleEndian.Uint16(b[cpa.offset:cpa.offset+cpa.size]) == 0 {
+		return 0, false
+	}
+	if NodeType(b[btreePageHeaderConfig[node_type].offset]) != LEAF_NODE {
+		return 0, false
+	}
+	rmp := btreePageHeaderConfig[right_most_pointer]
+	return binary.LittleEndian.Uint64(b[rmp.offset : rmp.offset+rmp.size]), true
+}
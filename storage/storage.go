@@ -2,12 +2,34 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"os"
+	"sync"
+)
+
+//Mode controls how Open treats the database file
+type Mode int
+
+const (
+	MODE_READ_ONLY  Mode = iota //the file must exist and is never written to
+	MODE_READ_WRITE             //the file must exist
+	MODE_CREATE                 //the file is created if it doesn't exist but never truncated
+)
+
+var (
+	ErrReadOnly    = errors.New("storage: database is read-only")
+	ErrNotDatabase = errors.New("storage: file is not a database")
+	ErrFormat      = errors.New("storage: database was written in another file format version")
 )
 
 type storage struct {
+	mu            sync.Mutex //guards the header fields, trees write pages from several goroutines
 	file          *os.File
 	firstFreePage uint64
+	freeList      uint64 //offset of the first freed page, 0 when there aren't any
+	freeCount     uint32
+	readOnly      bool
+	readahead     readahead
 }
 
 type Storer interface {
@@ -15,7 +37,9 @@ type Storer interface {
 	WritePage(p *page)
 	Get(offset uint64, length int) []byte
 	GetFreePage() uint64
+	ReadOnly() bool
 	writeHeader()
+	freePage(offset uint64)
 }
 
 //UGLY!!!!!!!
@@ -46,22 +70,67 @@ func Create(name string) (*storage, error) {
 	return s, nil
 }
 
-func Open(name string) (*storage, error) {
-	f, err := os.OpenFile(name, os.O_RDWR, 0)
+//Open opens an existing database. Unlike Create it never truncates the file,
+//MODE_CREATE only initializes a header when the file is new.
+func Open(name string, mode Mode) (*storage, error) {
+	var flag int
+	switch mode {
+	case MODE_READ_ONLY:
+		flag = os.O_RDONLY
+	case MODE_READ_WRITE:
+		flag = os.O_RDWR
+	case MODE_CREATE:
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(name, flag, 0644)
 	if err != nil {
 		return nil, err
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 	s := &storage{
 		file:          f,
 		firstFreePage: db_header_length + 1 + page_length,
+		readOnly:      mode == MODE_READ_ONLY,
+	}
+	switch {
+	case fi.Size() == 0 && mode == MODE_CREATE:
+		s.writeHeader()
+	case fi.Size() < db_header_length:
+		f.Close()
+		return nil, ErrNotDatabase
+	default:
+		if err := s.parseHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
 	}
-	s.parseHeader()
 
 	store = s
 	return s, nil
 }
 
+/*
+Free list:
+Freed pages are zeroed and chained together through the right most pointer
+in their page header. Because the cell pointer array of a zeroed page is 0
+a freed page reads back as an empty page.
+*/
+
 func (s *storage) GetFreePage() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.freeList != 0 {
+		offset := s.freeList
+		rmp := btreePageHeaderConfig[right_most_pointer]
+		s.freeList = binary.LittleEndian.Uint64(s.Get(offset+uint64(rmp.offset), rmp.size))
+		s.freeCount--
+		s.flushHeader()
+		return (offset - 1 - db_header_length) / page_length
+	}
 	defer func() {
 		s.firstFreePage += page_length
 
@@ -69,6 +138,23 @@ func (s *storage) GetFreePage() uint64 {
 	return (s.firstFreePage - 1 - db_header_length) / page_length
 }
 
+func (s *storage) freePage(offset uint64) {
+	if s.readOnly {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var b [page_length]byte
+	rmp := btreePageHeaderConfig[right_most_pointer]
+	binary.LittleEndian.PutUint64(b[rmp.offset:rmp.offset+rmp.size], s.freeList)
+	s.readahead.invalidate(offset)
+	s.file.WriteAt(b[:], int64(offset))
+	s.readahead.invalidate(offset)
+	s.freeList = offset
+	s.freeCount++
+	s.flushHeader()
+}
+
 func GetPageNumber(number int) *page {
 	return &page{
 		offset: uint64(number*page_length + db_header_length + 1),
@@ -76,33 +162,79 @@ func GetPageNumber(number int) *page {
 	}
 }
 
+//PageNumber is the number of the page at offset, the other way round from GetPageNumber
+func PageNumber(offset uint64) int {
+	return int((offset - 1 - db_header_length) / page_length)
+}
+
+func (s *storage) ReadOnly() bool {
+	return s.readOnly
+}
+
 func (s *storage) writeHeader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushHeader()
+}
+
+//flushHeader writes the header with s.mu held
+func (s *storage) flushHeader() {
+	if s.readOnly {
+		return
+	}
 	var h dbHeader
 	copy(h[header_string_offset:header_string_offset+header_string_size], header_string)
 	binary.LittleEndian.PutUint16(h[page_size_offset:page_size_offset+page_size_length], uint16(page_length))
+	binary.LittleEndian.PutUint16(h[format_offset:format_offset+format_size], format_version)
 	binary.LittleEndian.PutUint32(h[free_page_offset:free_page_offset+free_page_size], uint32(s.firstFreePage))
+	binary.LittleEndian.PutUint64(h[free_list_offset:free_list_offset+free_list_size], s.freeList)
+	binary.LittleEndian.PutUint32(h[free_count_offset:free_count_offset+free_count_size], s.freeCount)
 	s.file.WriteAt(h[:], 0)
 }
 
-func (s *storage) parseHeader() {
+//parseHeader reads the header of an existing file, it has to be a database
+//in the format version this code writes
+func (s *storage) parseHeader() error {
 	h := s.Get(0, db_header_length)
+	if string(h[header_string_offset:header_string_offset+header_string_size]) != header_string {
+		return ErrNotDatabase
+	}
+	if binary.LittleEndian.Uint16(h[format_offset:format_offset+format_size]) != format_version {
+		return ErrFormat
+	}
 	s.firstFreePage = uint64(binary.LittleEndian.Uint32(h[free_page_offset : free_page_offset+free_page_size]))
+	s.freeList = binary.LittleEndian.Uint64(h[free_list_offset : free_list_offset+free_list_size])
+	s.freeCount = binary.LittleEndian.Uint32(h[free_count_offset : free_count_offset+free_count_size])
+	return nil
 }
 
 func (s *storage) Close() {
+	s.readahead.close()
 	defer s.file.Close()
 }
 func (s *storage) WritePage(p *page) {
+	if s.readOnly {
+		return
+	}
 	// fmt.Println("WRITE PAGE", p.offset)
 	// return
+	s.readahead.invalidate(p.offset)
 	s.file.WriteAt(p.buffer[:], int64(p.offset))
+	s.readahead.invalidate(p.offset)
 	// fi, _ := s.file.Stat()
 	// fmt.Println("File size:", fi.Size())
 }
 
 func (s *storage) Get(offset uint64, length int) []byte {
+	if length == page_length {
+		if b := s.readahead.take(offset); b != nil {
+			s.readahead.observe(s, offset, b)
+			return b
+		}
+	}
 	b := make([]byte, length)
 	s.file.ReadAt(b, int64(offset))
+	s.readahead.observe(s, offset, b)
 	// fmt.Println("FETCH FROM DISK")
 	// fi, _ := s.file.Stat()
 	// fmt.Println("File size:", fi.Size())
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Open_ReadOnly_Missing(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "missing.db")
+	if _, err := Open(name, MODE_READ_ONLY); err == nil {
+		t.Error("Expected an error opening a missing file read-only")
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Error("read-only open created the file")
+	}
+}
+
+func Test_Open_Create_Keeps_Data(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := GetPageNumber(0)
+	p.WriteLeaf([][]byte{[]byte{7}}, [][]byte{[]byte{7}}, nil)
+	s.Close()
+
+	s, err = Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	keys, _, _ := GetPageNumber(0).FetchLeaf()
+	if len(keys) != 1 || !bytes.Equal(keys[0], []byte{7}) {
+		t.Errorf("Expected the existing page to survive; got keys %v", keys)
+	}
+}
+
+func Test_Open_Old_Format(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	//a file from before there was a version
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(make([]byte, format_size), format_offset)
+	f.Close()
+	if _, err := Open(name, MODE_READ_WRITE); err != ErrFormat {
+		t.Errorf("Expected ErrFormat; got %v", err)
+	}
+
+	other := filepath.Join(t.TempDir(), "other")
+	os.WriteFile(other, bytes.Repeat([]byte("not a database "), 10), 0644)
+	if _, err := Open(other, MODE_READ_WRITE); err != ErrNotDatabase {
+		t.Errorf("Expected ErrNotDatabase; got %v", err)
+	}
+}
+
+func Test_Open_ReadOnly_No_Writes(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(name, MODE_READ_ONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if !s.ReadOnly() {
+		t.Error("Expected a read-only store")
+	}
+	GetPageNumber(0).WriteLeaf([][]byte{[]byte{1}}, [][]byte{[]byte{1}}, nil)
+	keys, _, _ := GetPageNumber(0).FetchLeaf()
+	if len(keys) != 0 {
+		t.Errorf("Expected no keys on a read-only store; got %v", keys)
+	}
+}
+
+func Test_Readahead_Sequential_Leaves(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	//a chain of leaves 1 -> 2 -> ... -> 12
+	numberOfLeaves := 12
+	for n := numberOfLeaves; n > 0; n-- {
+		var right Pager
+		if n < numberOfLeaves {
+			right = GetPageNumber(n + 1)
+		}
+		GetPageNumber(n).WriteLeaf([][]byte{[]byte{byte(n)}}, [][]byte{[]byte{byte(n)}}, right)
+	}
+
+	GetPageNumber(1).FetchLeaf()
+	GetPageNumber(2).FetchLeaf()
+	s.readahead.wg.Wait()
+	if len(s.readahead.pages) == 0 {
+		t.Fatal("Expected pages to be prefetched after a sequential scan")
+	}
+
+	//a write must not be hidden by a prefetched copy
+	GetPageNumber(3).WriteLeaf([][]byte{[]byte{33}}, [][]byte{[]byte{33}}, GetPageNumber(4))
+
+	for n := 3; n <= numberOfLeaves; n++ {
+		keys, _, _ := GetPageNumber(n).FetchLeaf()
+		expected := byte(n)
+		if n == 3 {
+			expected = 33
+		}
+		if len(keys) != 1 || !bytes.Equal(keys[0], []byte{expected}) {
+			t.Errorf("Leaf %d: Expected key %d; got %v", n, expected, keys)
+		}
+	}
+}
+
+func Test_Temp_Spill(t *testing.T) {
+	s := CreateTemp()
+	var pages []*page
+	for n := 0; n < temp_memory_pages*2; n++ {
+		p := NewPageIn(s)
+		p.WriteLeaf([][]byte{[]byte{byte(n)}}, [][]byte{[]byte{byte(n)}}, nil)
+		pages = append(pages, p)
+	}
+	if s.file == nil {
+		t.Fatal("Expected temp storage to spill to a file")
+	}
+	for n, p := range pages {
+		fetched := &page{offset: p.Offset(), header: NewPageHeader(), store: s}
+		keys, _, _ := fetched.FetchLeaf()
+		if len(keys) != 1 || !bytes.Equal(keys[0], []byte{byte(n)}) {
+			t.Errorf("Page %d: Expected key %d; got %v", n, n, keys)
+		}
+	}
+	s.Close()
+}
+
+func Test_Free_List(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.db")
+	s, err := Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPage()
+	p.WriteLeaf([][]byte{[]byte{1}}, [][]byte{[]byte{1}}, nil)
+	freed := p.Offset()
+	p.Free()
+	s.Close()
+
+	s, err = Open(name, MODE_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.freeCount != 1 {
+		t.Errorf("Expected 1 free page; got %d", s.freeCount)
+	}
+	reused := NewPage()
+	if reused.Offset() != freed {
+		t.Errorf("Expected page at %d to be reused; got %d", freed, reused.Offset())
+	}
+	if keys, _, _ := reused.FetchLeaf(); len(keys) != 0 {
+		t.Errorf("Expected a reused page to be empty; got keys %v", keys)
+	}
+	if NewPage().Offset() == freed {
+		t.Error("Free page handed out twice")
+	}
+}
+
+func Test_Page_Number(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 1000} {
+		if got := PageNumber(GetPageNumber(n).Offset()); got != n {
+			t.Errorf("Expected page %d; got %d", n, got)
+		}
+	}
+}
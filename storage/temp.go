@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"os"
+	"sync"
+)
+
+/*
+Temp storage is scratch space for sorting and ephemeral tables.
+Pages live in memory until there are more than temp_memory_pages of them,
+then everything moves to an anonymous file that is unlinked as soon as it is
+created. Nothing is written to the main database file and Close throws it all away.
+*/
+
+const (
+	temp_memory_pages = 64
+)
+
+type tempStorage struct {
+	mu            sync.Mutex
+	pages         map[uint64][]byte
+	file          *os.File
+	firstFreePage uint64
+	free          []uint64 //offsets of freed pages
+}
+
+func CreateTemp() *tempStorage {
+	return &tempStorage{
+		pages:         map[uint64][]byte{},
+		firstFreePage: db_header_length + 1,
+	}
+}
+
+func (s *tempStorage) GetFreePage() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.free); n > 0 {
+		offset := s.free[n-1]
+		s.free = s.free[:n-1]
+		return (offset - 1 - db_header_length) / page_length
+	}
+	defer func() {
+		s.firstFreePage += page_length
+	}()
+	return (s.firstFreePage - 1 - db_header_length) / page_length
+}
+
+func (s *tempStorage) WritePage(p *page) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.WriteAt(p.buffer[:], int64(p.offset))
+		return
+	}
+	b := make([]byte, page_length)
+	copy(b, p.buffer[:])
+	s.pages[p.offset] = b
+	if len(s.pages) > temp_memory_pages {
+		s.spill()
+	}
+}
+
+//spill moves the in memory pages to a temp file.
+//If we can't get a file we just keep going in memory.
+func (s *tempStorage) spill() {
+	f, err := os.CreateTemp("", "seaquell-*.tmp")
+	if err != nil {
+		return
+	}
+	//the file stays around until it's closed but nobody else can find it
+	os.Remove(f.Name())
+	for offset, b := range s.pages {
+		if _, err := f.WriteAt(b, int64(offset)); err != nil {
+			f.Close()
+			return
+		}
+	}
+	s.file = f
+	s.pages = nil
+}
+
+//freed pages have to read back as empty pages when they're reused
+func (s *tempStorage) freePage(offset uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		var b [page_length]byte
+		s.file.WriteAt(b[:], int64(offset))
+	} else {
+		delete(s.pages, offset)
+	}
+	s.free = append(s.free, offset)
+}
+
+func (s *tempStorage) Get(offset uint64, length int) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := make([]byte, length)
+	if s.file != nil {
+		s.file.ReadAt(b, int64(offset))
+		return b
+	}
+	copy(b, s.pages[offset])
+	return b
+}
+
+func (s *tempStorage) ReadOnly() bool {
+	return false
+}
+
+//temp storage has no header
+func (s *tempStorage) writeHeader() {
+
+}
+
+func (s *tempStorage) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+	s.pages = nil
+}
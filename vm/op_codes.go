@@ -29,6 +29,9 @@ const (
 	OP_COLUMN_NAME //names of the columns in the return data
 	OP_REWIND
 	OP_NEXT
+	OP_OPEN_EPHEMERAL //open a scratch table that is thrown away when the statement finishes
+	OP_LAST           //like OP_REWIND but starts at the last row, jumps past the loop if there isn't one
+	OP_PREV           //like OP_NEXT but moves backwards
 )
 
 type DataType int
@@ -102,6 +105,12 @@ func (o OpCode) String() string {
 		return "OP_REWIND"
 	case OP_NEXT:
 		return "OP_NEXT"
+	case OP_OPEN_EPHEMERAL:
+		return "OP_OPEN_EPHEMERAL"
+	case OP_LAST:
+		return "OP_LAST"
+	case OP_PREV:
+		return "OP_PREV"
 	}
 	return "NONE"
 }